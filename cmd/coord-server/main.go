@@ -6,8 +6,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/nyiyui/qrystal/coord"
+	"github.com/nyiyui/qrystal/goal"
 	"github.com/nyiyui/qrystal/profile"
 	"github.com/nyiyui/qrystal/spec"
 	"github.com/nyiyui/qrystal/util"
@@ -20,6 +24,13 @@ type Config struct {
 	Addr     string
 	CertPath string
 	KeyPath  string
+	// StorePath is the path to the file the spec (including changes made by devices) is persisted in.
+	// Leave blank to keep the spec in memory only.
+	StorePath string
+	// WatchInterval is how often the config file is checked for changes.
+	// If it has changed, Spec and Tokens are reloaded (like on SIGHUP).
+	// Leave blank to only reload on SIGHUP.
+	WatchInterval goal.Duration
 }
 
 func main() {
@@ -27,10 +38,12 @@ func main() {
 	var addr string
 	var certPath string
 	var keyPath string
+	var storePath string
 	flag.StringVar(&configPath, "config", "", "Config file path.")
 	flag.StringVar(&addr, "addr", "", "Bind address. Overridden by config file if present.")
 	flag.StringVar(&certPath, "cert", "", "Certificate for HTTPS server. Supplying this will enable HTTPS and disable HTTP. Overridden by config file if present.")
 	flag.StringVar(&keyPath, "key", "", "Key for HTTPS server. Supplying this will enable HTTPS and disable HTTP. Overridden by config file if present.")
+	flag.StringVar(&storePath, "store", "", "Path to file to persist the spec in. Overridden by config file if present.")
 	flag.Parse()
 	util.SetupLog()
 	defer util.S.Sync()
@@ -49,6 +62,9 @@ func main() {
 	if c.KeyPath != "" {
 		keyPath = c.KeyPath
 	}
+	if c.StorePath != "" {
+		storePath = c.StorePath
+	}
 	if (certPath == "") != (keyPath == "") {
 		zap.S().Fatalf("both or none of certPath and keyPath must be provided")
 	}
@@ -56,7 +72,29 @@ func main() {
 	if err != nil {
 		zap.S().Fatalf("loading config failed: %s", err)
 	}
+	err = c.Spec.Validate()
+	if err != nil {
+		zap.S().Fatalf("spec is invalid:\n%s", err)
+	}
+	if storePath == "" {
+		// otherwise, addresses are assigned after merging with the stored spec, so they are kept across restarts
+		err = c.Spec.AssignAddresses()
+		if err != nil {
+			zap.S().Fatalf("assigning addresses failed: %s", err)
+		}
+	}
+	if storePath == "" && coord.HasEnrollTokens(tokens) {
+		zap.S().Fatalf("loading config failed: %s; set StorePath", coord.ErrEnrollWithoutStore)
+	}
 	s := coord.NewServer(c.Spec, tokens)
+	if storePath != "" {
+		err = s.SetStore(coord.NewFileStore(storePath))
+		if err != nil {
+			zap.S().Fatalf("loading store failed: %s", err)
+		}
+		zap.S().Infof("loaded store from %s.", storePath)
+	}
+	go handleReload(s, configPath, time.Duration(c.WatchInterval))
 	if certPath != "" && keyPath != "" {
 		err = util.Notify("READY=1\nSTATUS=serving HTTPS…")
 	} else {
@@ -72,6 +110,65 @@ func main() {
 	}
 }
 
+// handleReload reloads Spec and Tokens from the config file on SIGHUP, and when the config file changes (if watchInterval is nonzero).
+func handleReload(s *coord.Server, configPath string, watchInterval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	var lastModTime time.Time
+	if watchInterval != 0 {
+		info, err := os.Stat(configPath)
+		if err != nil {
+			zap.S().Errorf("watching config: %s", err)
+		} else {
+			lastModTime = info.ModTime()
+		}
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-hup:
+			zap.S().Info("received SIGHUP; reloading config.")
+		case <-tick:
+			info, err := os.Stat(configPath)
+			if err != nil {
+				zap.S().Errorf("watching config: %s", err)
+				continue
+			}
+			if info.ModTime().Equal(lastModTime) {
+				continue
+			}
+			lastModTime = info.ModTime()
+			zap.S().Info("config changed; reloading config.")
+		}
+		// no RELOADING=1, as the unit uses ExecReload= (not Type=notify-reload, which would require MONOTONIC_USEC=)
+		util.Notify("STATUS=reloading config…")
+		err := reload(s, configPath)
+		if err != nil {
+			zap.S().Errorf("reloading config failed (keeping previous config): %s", err)
+			util.Notify(fmt.Sprintf("READY=1\nSTATUS=reloading config failed (keeping previous config): %s", err))
+		} else {
+			util.Notify(fmt.Sprintf("READY=1\nSTATUS=reloaded config at %s", time.Now().Format(time.RFC3339)))
+		}
+	}
+}
+
+// reload reloads Spec and Tokens from the config file.
+// Other fields (e.g. Addr) are not reloaded, and require a restart.
+func reload(s *coord.Server, configPath string) error {
+	c, err := loadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	tokens, err := convertTokens(c.Tokens)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	return s.Reload(c.Spec, tokens)
+}
+
 func loadConfig(path string) (Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -92,6 +189,10 @@ func convertTokens(tokens map[string]coord.TokenInfo) (map[util.TokenHash]coord.
 		if err != nil {
 			return nil, fmt.Errorf("parsing token hash %s: %w", key, err)
 		}
+		err = val.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("token %s: %w", key, err)
+		}
 		tokens2[*tokenHash] = val
 	}
 	return tokens2, nil
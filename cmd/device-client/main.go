@@ -4,15 +4,23 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/nyiyui/qrystal/device"
 	"github.com/nyiyui/qrystal/dns"
 	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
 	"github.com/nyiyui/qrystal/util"
 	"go.uber.org/zap"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -22,19 +30,52 @@ type Config struct {
 	Clients    map[string]ClientConfig
 	CanForward bool
 	AssumeProc bool
+	// DriftCheckInterval is how often to check whether the applied machine was changed by something else (and reapply it if so).
+	// Set to 0 to disable.
+	DriftCheckInterval goal.Duration
+	// FailoverCheckInterval is how often to check the handshakes of peers, and choose another endpoint (or a forwarder) for unreachable peers.
+	// Set to 0 to disable.
+	FailoverCheckInterval goal.Duration
+	// StatePath is the file to record the interfaces (and sysctls) changed in, so they can be cleaned up by a later run (e.g. after a crash).
+	// Leave blank to not record them.
+	StatePath string
+	// EndpointScorer configures how the endpoints of peers are scored (see spec.ScorerConfig).
+	// Defaults to pinging the endpoints.
+	EndpointScorer spec.ScorerConfig
+	// ForwarderPolicy is how forwarders are chosen for peers without a working endpoint (see spec.ForwarderPolicy).
+	// Defaults to spec.ForwarderHash.
+	ForwarderPolicy spec.ForwarderPolicy
+	// ShutdownPolicy is what to do with the interfaces on SIGTERM or SIGINT: ShutdownLeave (the default) or ShutdownTeardown.
+	ShutdownPolicy ShutdownPolicy
 }
 
+type ShutdownPolicy string
+
+const (
+	// ShutdownLeave leaves the interfaces as they are, so connections keep working while the device client is stopped.
+	ShutdownLeave ShutdownPolicy = "leave"
+	// ShutdownTeardown removes the interfaces, and restores the sysctls changed.
+	ShutdownTeardown ShutdownPolicy = "teardown"
+)
+
 type ClientConfig struct {
-	BaseURL         string
-	Token           util.Token
-	TokenPath       string
+	BaseURL   string
+	Token     util.Token
+	TokenPath string
+	// EnrollToken is an enrollment token used to create the device if TokenPath does not exist.
+	// The token returned by enrollment is saved to TokenPath, which is required.
+	EnrollToken     util.Token
+	EnrollTokenPath string
 	Network         string
 	Device          string
 	PrivateKey      goal.Key
 	PrivateKeyPath  string
 	MinimumInterval goal.Duration
-	CertPath        string
-	transport       *http.Transport
+	// LongPollWait is how long to wait for a spec change in a single request to the coordination server.
+	// Set to 0 to disable long-polling.
+	LongPollWait goal.Duration
+	CertPath     string
+	transport    *http.Transport
 }
 
 func main() {
@@ -45,11 +86,17 @@ func main() {
 	var dnsConfigPath string
 	var dnsAddr string
 	var dnsSelf bool
+	var dryRun bool
+	var printJSON bool
+	var pathTo string
 	flag.StringVar(&configPath, "config", "", "path to config file (required)")
 	flag.StringVar(&dnsSocketPath, "dns-socket", "", "socket to connect to DNS server (optional)")
 	flag.StringVar(&dnsConfigPath, "dns-config", "", "path to DNS config file (required for -dns-self)")
 	flag.StringVar(&dnsAddr, "dns-addr", "", "address to listen on for DNS")
 	flag.BoolVar(&dnsSelf, "dns-self", false, "act as the DNS server itself")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the changes the specs would make to this machine, and exit")
+	flag.BoolVar(&printJSON, "json", false, "print the changes as JSON (with -dry-run)")
+	flag.StringVar(&pathTo, "path-to", "", "print the devices packets to network/device pass through, and exit")
 	flag.Parse()
 	configData, err := os.ReadFile(configPath)
 	if err != nil {
@@ -60,6 +107,17 @@ func main() {
 	if err != nil {
 		zap.S().Fatalf("parsing config file failed: %s", err)
 	}
+	err = config.ForwarderPolicy.Validate()
+	if err != nil {
+		zap.S().Fatalf("parsing config file failed: ForwarderPolicy: %s", err)
+	}
+	switch config.ShutdownPolicy {
+	case "":
+		config.ShutdownPolicy = ShutdownLeave
+	case ShutdownLeave, ShutdownTeardown:
+	default:
+		zap.S().Fatalf("parsing config file failed: unknown ShutdownPolicy %q", config.ShutdownPolicy)
+	}
 	for key, cc := range config.Clients {
 		if cc.PrivateKeyPath != "" {
 			data, err := os.ReadFile(cc.PrivateKeyPath)
@@ -72,16 +130,34 @@ func main() {
 			}
 			cc.PrivateKey = goal.Key(privateKey)
 		}
-		if cc.TokenPath != "" {
-			data, err := os.ReadFile(cc.TokenPath)
+		if (!cc.EnrollToken.Empty() || cc.EnrollTokenPath != "") && cc.TokenPath == "" {
+			// the issued token must be saved, as the enrollment token cannot be used again
+			zap.S().Fatalf("parsing config file failed: client %s: EnrollToken and EnrollTokenPath require TokenPath", key)
+		}
+		if cc.EnrollTokenPath != "" {
+			data, err := os.ReadFile(cc.EnrollTokenPath)
 			if err != nil {
-				zap.S().Fatalf("parsing config file failed: client %s: reading token path: %s", key, err)
+				zap.S().Fatalf("parsing config file failed: client %s: reading enroll token path: %s", key, err)
 			}
 			tok, err := util.ParseToken(string(data))
 			if err != nil {
-				zap.S().Fatalf("parsing config file failed: client %s: parsing token path: %s", key, err)
+				zap.S().Fatalf("parsing config file failed: client %s: parsing enroll token path: %s", key, err)
+			}
+			cc.EnrollToken = *tok
+		}
+		if cc.TokenPath != "" {
+			data, err := os.ReadFile(cc.TokenPath)
+			if errors.Is(err, fs.ErrNotExist) && !cc.EnrollToken.Empty() {
+				// not enrolled yet; enroll below
+			} else if err != nil {
+				zap.S().Fatalf("parsing config file failed: client %s: reading token path: %s", key, err)
+			} else {
+				tok, err := util.ParseToken(string(data))
+				if err != nil {
+					zap.S().Fatalf("parsing config file failed: client %s: parsing token path: %s", key, err)
+				}
+				cc.Token = *tok
 			}
-			cc.Token = *tok
 		}
 		if cc.CertPath != "" {
 			pool := x509.NewCertPool()
@@ -96,6 +172,23 @@ func main() {
 			zap.S().Infof("client %s: loaded cert from %s", key, cc.CertPath)
 			cc.transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
 		}
+		if cc.Token.Empty() && !cc.EnrollToken.Empty() {
+			zap.S().Infof("client %s: enrolling…", key)
+			httpClient := &http.Client{Timeout: 5 * time.Second}
+			if cc.transport != nil {
+				httpClient.Transport = cc.transport
+			}
+			tok, err := device.Enroll(httpClient, cc.BaseURL, cc.EnrollToken, cc.Network, cc.Device)
+			if err != nil {
+				zap.S().Fatalf("client %s: enrolling failed: %s", key, err)
+			}
+			cc.Token = *tok
+			err = util.WriteFileAtomic(cc.TokenPath, []byte(tok.String()), 0600)
+			if err != nil {
+				zap.S().Fatalf("client %s: saving token to token path failed: %s", key, err)
+			}
+			zap.S().Infof("client %s: enrolled.", key)
+		}
 		config.Clients[key] = cc
 	}
 	data, err := json.Marshal(config)
@@ -104,6 +197,38 @@ func main() {
 	}
 	zap.S().Infof("parsed config:\n%s", data)
 
+	if pathTo != "" {
+		network, name, ok := strings.Cut(pathTo, "/")
+		if !ok {
+			zap.S().Fatalf("-path-to: %q is not in the form network/device", pathTo)
+		}
+		c := createClient(config)
+		path, err := c.PathTo(network, name)
+		if err != nil {
+			zap.S().Fatalf("finding path failed: %s", err)
+		}
+		fmt.Println(strings.Join(path, " → "))
+		return
+	}
+
+	if dryRun {
+		c := createClient(config)
+		p, err := c.PlanSpec()
+		if err != nil {
+			zap.S().Fatalf("planning failed: %s", err)
+		}
+		if printJSON {
+			data, err := json.MarshalIndent(p, "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			fmt.Println(string(data))
+		} else {
+			fmt.Println(p)
+		}
+		return
+	}
+
 	var dnsClient dns.Client
 	if dnsSocketPath != "" {
 		zap.S().Infof("connecting to DNS server at %s…", dnsSocketPath)
@@ -147,30 +272,77 @@ func main() {
 	createGoroutines(dnsClient, config)
 }
 
+func sortedClientNames(config Config) []string {
+	clientNames := make([]string, 0, len(config.Clients))
+	for clientName := range config.Clients {
+		clientNames = append(clientNames, clientName)
+	}
+	slices.Sort(clientNames)
+	return clientNames
+}
+
+// createClient returns a client for all networks in config.
+func createClient(config Config) *device.Client {
+	// all networks are reconciled by one client, so that they are applied together (instead of fighting over interfaces and DNS)
+	clientNames := sortedClientNames(config)
+	var c *device.Client
+	for _, clientName := range clientNames {
+		cc := config.Clients[clientName]
+		httpClient := &http.Client{Timeout: 5 * time.Second}
+		if cc.transport != nil {
+			httpClient.Transport = cc.transport
+		}
+		var err error
+		if c == nil {
+			c, err = device.NewClient(httpClient, cc.BaseURL, cc.Token, cc.Network, cc.Device, cc.PrivateKey)
+		} else {
+			err = c.AddNetwork(httpClient, cc.BaseURL, cc.Token, cc.Network, cc.Device, cc.PrivateKey)
+		}
+		if err != nil {
+			zap.S().Fatalf("%s: creating client failed: %s", clientName, err)
+		}
+		zap.S().Infof("%s: added network %s.", clientName, cc.Network)
+	}
+	if c == nil {
+		zap.S().Fatal("no clients configured")
+	}
+	c.SetCanForward(config.CanForward)
+	scorer, err := config.EndpointScorer.Scorer()
+	if err != nil {
+		zap.S().Fatalf("parsing config file failed: EndpointScorer.%s", err)
+	}
+	c.SetEndpointScorer(scorer)
+	c.SetForwarderPolicy(config.ForwarderPolicy)
+	applier, err := goal.NewApplier(goal.ApplierOptions{
+		StatePath: config.StatePath,
+		Linux:     goal.ApplierOptionsLinux{ReadWriteProc: !config.AssumeProc},
+	})
+	if err != nil {
+		zap.S().Fatalf("creating applier failed: %s", err)
+	}
+	c.SetApplier(applier)
+	zap.S().Info("created client.")
+	return c
+}
+
 func createGoroutines(dnsClient dns.Client, config Config) {
 	util.Notify("READY=1\nSTATUS=starting…")
-	for clientName, cc := range config.Clients {
+	c := createClient(config)
+	c.SetDNSClient(dnsClient)
+
+	for _, clientName := range sortedClientNames(config) {
 		go func(clientName string, cc ClientConfig) {
-			c, err := device.NewClient(&http.Client{
-				Timeout: 5 * time.Second,
-				//Transport: cc.transport, // TODO: nil pointer
-			}, cc.BaseURL, cc.Token, cc.Network, cc.Device, cc.PrivateKey)
-			if err != nil {
-				panic(err)
-			}
-			c.SetCanForward(config.CanForward)
-			c.SetAssumeProc(config.AssumeProc)
-			c.SetDNSClient(dnsClient)
 			continuous := new(device.ContinousClient)
 			continuous.Client = c
-			zap.S().Infof("%s: created client.", clientName)
+			continuous.Network = cc.Network
+			continuous.LongPollWait = time.Duration(cc.LongPollWait)
 
 			t := time.NewTicker(time.Duration(cc.MinimumInterval))
 			for {
 				latest := false
+				var err error
 				for !latest {
 					var updated bool
-					var err error
 					latest, updated, err = continuous.Step()
 					if err != nil {
 						zap.S().Errorf("%s: %s", clientName, err)
@@ -193,9 +365,73 @@ func createGoroutines(dnsClient dns.Client, config Config) {
 					zap.S().Info("sleeping 1 second until next loop.")
 					time.Sleep(1 * time.Second)
 				}
+				if err == nil && continuous.LongPolls() {
+					// the next request waits for a change, so don't wait for the ticker, which would delay changes made in the meantime
+					continue
+				}
 				<-t.C
 			}
-		}(clientName, cc)
+		}(clientName, config.Clients[clientName])
+	}
+	if config.DriftCheckInterval != 0 {
+		go checkDrift(c, time.Duration(config.DriftCheckInterval))
+	}
+	if config.FailoverCheckInterval != 0 {
+		go checkFailover(c, time.Duration(config.FailoverCheckInterval))
+	}
+	handleShutdown(c, config.ShutdownPolicy)
+}
+
+// handleShutdown waits for SIGTERM or SIGINT, and then exits after applying the shutdown policy.
+func handleShutdown(c *device.Client, policy ShutdownPolicy) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	zap.S().Infof("received %s, shutting down (policy %s)…", sig, policy)
+	util.Notify("STOPPING=1")
+	if policy == ShutdownTeardown {
+		err := c.Teardown()
+		if err != nil {
+			zap.S().Fatalf("teardown failed: %s", err)
+		}
+		zap.S().Info("tore down interfaces.")
+	}
+	os.Exit(0)
+}
+
+// checkFailover periodically chooses other endpoints (or forwarders) for unreachable peers.
+func checkFailover(c *device.Client, interval time.Duration) {
+	t := time.NewTicker(interval)
+	for range t.C {
+		failedOver, err := c.Failover()
+		if err != nil {
+			zap.S().Errorf("failover check: %s", err)
+			util.Notify(fmt.Sprintf("STATUS=failover check failed: %s", err))
+			continue
+		}
+		if len(failedOver) != 0 {
+			zap.S().Infof("failed over %v.", failedOver)
+			util.Notify(fmt.Sprintf("STATUS=failed over %d peers", len(failedOver)))
+		}
+	}
+}
+
+// checkDrift periodically reapplies the machine if it was changed by something else (e.g. ip link del or wg set).
+func checkDrift(c *device.Client, interval time.Duration) {
+	t := time.NewTicker(interval)
+	for range t.C {
+		drifts, err := c.Heal()
+		for _, d := range drifts {
+			zap.S().Warnf("drift: %s", d)
+		}
+		if err != nil {
+			zap.S().Errorf("drift check: %s", err)
+			util.Notify(fmt.Sprintf("STATUS=drift check failed: %s", err))
+			continue
+		}
+		if len(drifts) != 0 {
+			zap.S().Infof("reapplied machine after %d drifts.", len(drifts))
+			util.Notify(fmt.Sprintf("STATUS=reapplied machine after %d drifts", len(drifts)))
+		}
 	}
-	select {}
 }
@@ -1,32 +1,104 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
+	"github.com/nyiyui/qrystal/coord"
 	"github.com/nyiyui/qrystal/util"
 )
 
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseTime parses an RFC 3339 time, or a duration from now.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		return time.Now().Add(d).UTC().Truncate(time.Second), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
 func main() {
 	var formatJson bool
+	var identities listFlag
+	var scopes listFlag
+	var notBefore string
+	var notAfter string
 	flag.BoolVar(&formatJson, "json", false, "JSONを出力します。")
+	flag.Var(&identities, "identity", "network/device the token can identify as. Can be specified multiple times.")
+	flag.Var(&scopes, "scope", "scope of the token (reify:read, reify:patch, or admin). Can be specified multiple times. Leave unspecified for reify:read and reify:patch.")
+	flag.StringVar(&notBefore, "not-before", "", "time (RFC 3339, or a duration from now) from which the token is valid.")
+	flag.StringVar(&notAfter, "not-after", "", "time (RFC 3339, or a duration from now) until which the token is valid.")
 	flag.Parse()
 
+	var info coord.TokenInfo
+	for _, identity := range identities {
+		network, device, ok := strings.Cut(identity, "/")
+		if !ok {
+			log.Fatalf("identity %s: must be in the format network/device", identity)
+		}
+		info.Identities = append(info.Identities, [2]string{network, device})
+	}
+	for _, scope := range scopes {
+		info.Scopes = append(info.Scopes, coord.Scope(scope))
+	}
+	var err error
+	info.NotBefore, err = parseTime(notBefore)
+	if err != nil {
+		log.Fatalf("parsing not-before: %s", err)
+	}
+	info.NotAfter, err = parseTime(notAfter)
+	if err != nil {
+		log.Fatalf("parsing not-after: %s", err)
+	}
+	err = info.Validate()
+	if err != nil {
+		log.Fatalf("invalid token info: %s", err)
+	}
+
 	token, err := util.RandomToken()
 	if err != nil {
 		log.Fatalf("gen hash/token: %s", err)
 	}
+	infoData, err := json.MarshalIndent(info, "    ", "  ")
+	if err != nil {
+		panic(err)
+	}
 	if formatJson {
 		fmt.Printf(`{
   "keys": {
-		"token": "%s",
-		"hash": "%s"
-	}
-}`, token, token.Hash().String())
+    "token": "%s",
+    "hash": "%s"
+  },
+  "tokens": {
+    "%s": %s
+  }
+}`, token, token.Hash().String(), token.Hash().String(), infoData)
 	} else {
 		fmt.Print("[keys]\n")
 		fmt.Printf("token = %s\n", token)
 		fmt.Printf("hash  = %s\n", token.Hash().String())
+		infoData, err = json.Marshal(info)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("info  = %s\n", infoData)
 	}
 }
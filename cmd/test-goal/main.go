@@ -5,7 +5,9 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
+	"slices"
 
 	"github.com/nyiyui/qrystal/goal"
 	"github.com/nyiyui/qrystal/util"
@@ -13,13 +15,24 @@ import (
 )
 
 var mPath string
+var dryRun bool
+var printJSON bool
+var observe bool
 
 func main() {
 	util.SetupLog()
 
 	flag.StringVar(&mPath, "m-path", "", "path to goal state")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the changes to make without making them")
+	flag.BoolVar(&printJSON, "json", false, "print the changes as JSON (with -dry-run)")
+	flag.BoolVar(&observe, "observe", false, "print the current state of all WireGuard interfaces (and how it differs from the goal state, if given)")
 	flag.Parse()
 
+	if observe {
+		runObserve()
+		return
+	}
+
 	zap.S().Info("parsing machine data…")
 	raw, err := os.ReadFile(mPath)
 	if err != nil {
@@ -37,8 +50,73 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	err = applier.ApplyMachine(m)
+	if !dryRun {
+		err = applier.ApplyMachine(m)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	p, err := applier.Plan(m)
+	if err != nil {
+		panic(err)
+	}
+	if printJSON {
+		data, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Println(p)
+	}
+}
+
+func runObserve() {
+	applier, err := goal.NewApplier(goal.ApplierOptions{})
+	if err != nil {
+		panic(err)
+	}
+	observed, err := applier.Observe(nil)
+	if err != nil {
+		panic(err)
+	}
+	// don't print private keys
+	redacted := observed
+	redacted.Interfaces = slices.Clone(observed.Interfaces)
+	for i := range redacted.Interfaces {
+		redacted.Interfaces[i].PrivateKey = goal.Key{}
+	}
+	data, err := json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(data))
+	if mPath == "" {
+		return
+	}
+	raw, err := os.ReadFile(mPath)
 	if err != nil {
 		panic(err)
 	}
+	var m goal.Machine
+	err = json.Unmarshal(raw, &m)
+	if err != nil {
+		panic(err)
+	}
+	drifts := goal.CompareMachines(m, observed)
+	if printJSON {
+		data, err := json.MarshalIndent(drifts, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if len(drifts) == 0 {
+		fmt.Println("no drift")
+	}
+	for _, d := range drifts {
+		fmt.Println(d)
+	}
 }
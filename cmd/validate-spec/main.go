@@ -0,0 +1,50 @@
+// Command validate-spec checks the spec in a coordination server config file for problems.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nyiyui/qrystal/spec"
+)
+
+func main() {
+	var configPath string
+	var specOnly bool
+	flag.StringVar(&configPath, "config", "", "Coordination server config file path.")
+	flag.BoolVar(&specOnly, "spec", false, "The file only contains a spec, instead of a coordination server config.")
+	flag.Parse()
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading config failed: %s\n", err)
+		os.Exit(2)
+	}
+	var c struct {
+		Spec spec.Spec
+	}
+	if specOnly {
+		err = json.Unmarshal(data, &c.Spec)
+	} else {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsing config failed: %s\n", err)
+		os.Exit(2)
+	}
+	err = c.Spec.Validate()
+	var errs spec.ValidationErrors
+	if errors.As(err, &errs) {
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		fmt.Fprintf(os.Stderr, "%d problem(s) found.\n", len(errs))
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "validating spec failed: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,310 @@
+package coord
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
+	"go.uber.org/zap"
+)
+
+func (s *Server) setupAdmin() {
+	s.mux.HandleFunc("GET /v1/admin/spec", s.getAdminSpec)
+	s.mux.HandleFunc("POST /v1/admin/networks", s.postAdminNetwork)
+	s.mux.HandleFunc("DELETE /v1/admin/networks/{network}", s.deleteAdminNetwork)
+	s.mux.HandleFunc("POST /v1/admin/networks/{network}/devices", s.postAdminDevice)
+	s.mux.HandleFunc("PATCH /v1/admin/networks/{network}/devices/{device}", s.patchAdminDevice)
+	s.mux.HandleFunc("DELETE /v1/admin/networks/{network}/devices/{device}", s.deleteAdminDevice)
+	s.mux.HandleFunc("GET /v1/admin/networks/{network}/devices/{device}/peers", s.getAdminDevicePeers)
+	s.mux.HandleFunc("GET /v1/admin/tokens/revoked", s.getAdminRevoked)
+	s.mux.HandleFunc("POST /v1/admin/tokens/revoked", s.postAdminRevoked)
+	s.mux.HandleFunc("DELETE /v1/admin/tokens/revoked/{hash}", s.deleteAdminRevoked)
+}
+
+// readJSON decodes the request body into v.
+// If this returns false, an error has been written to w, and the request should be aborted.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) (ok bool) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body", 500)
+		return false
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("json decode failed: %s\n%s", err, data), 400)
+		return false
+	}
+	return true
+}
+
+func (s *Server) getAdminSpec(w http.ResponseWriter, r *http.Request) {
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	s.specLock.RLock()
+	defer s.specLock.RUnlock()
+	data, err := json.Marshal(s.spec)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+func (s *Server) postAdminNetwork(w http.ResponseWriter, r *http.Request) {
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	var sn spec.Network
+	if !readJSON(w, r, &sn) {
+		return
+	}
+	err := sn.AssignAddresses()
+	if err != nil {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	err = sn.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	if _, ok := s.spec.GetNetwork(sn.Name); ok {
+		http.Error(w, "network already exists", 409)
+		return
+	}
+	newSpec := s.spec.Clone()
+	newSpec.Networks = append(newSpec.Networks, sn)
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	err = s.updateSpecNoLock(newSpec)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("added network %s.", sn.Name)
+	w.WriteHeader(204)
+}
+
+func (s *Server) deleteAdminNetwork(w http.ResponseWriter, r *http.Request) {
+	network := r.PathValue("network")
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	nI, ok := s.spec.GetNetworkIndex(network)
+	if !ok {
+		http.Error(w, "network not found", 404)
+		return
+	}
+	newSpec := s.spec.Clone()
+	newSpec.Networks = slices.Delete(newSpec.Networks, nI, nI+1)
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	err := s.updateSpecNoLock(newSpec)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("removed network %s.", network)
+	w.WriteHeader(204)
+}
+
+func (s *Server) postAdminDevice(w http.ResponseWriter, r *http.Request) {
+	network := r.PathValue("network")
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	var snd spec.NetworkDevice
+	if !readJSON(w, r, &snd) {
+		return
+	}
+	if snd.Name == "" {
+		http.Error(w, "device name must not be blank", 400)
+		return
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	nI, ok := s.spec.GetNetworkIndex(network)
+	if !ok {
+		http.Error(w, "network not found", 404)
+		return
+	}
+	if _, ok := s.spec.Networks[nI].GetDevice(snd.Name); ok {
+		http.Error(w, "device already exists", 409)
+		return
+	}
+	newSpec := s.spec.Clone()
+	newSpec.Networks[nI].Devices = append(newSpec.Networks[nI].Devices, snd)
+	err := newSpec.Networks[nI].AssignAddresses()
+	if err != nil {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	err = newSpec.Networks[nI].Validate()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	err = s.updateSpecNoLock(newSpec)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("added device %s/%s.", network, snd.Name)
+	w.WriteHeader(204)
+}
+
+type PatchAdminDeviceRequest struct {
+	// Endpoints replaces NetworkDeviceCensored.Endpoints.
+	Endpoints    []spec.Endpoint
+	EndpointsSet bool
+	// Addresses replaces NetworkDeviceCensored.Addresses.
+	// If empty, addresses are allocated from the network's AddressRanges.
+	Addresses    []goal.IPNet
+	AddressesSet bool
+	// AccessControl replaces NetworkDevice.AccessControl.
+	AccessControl    spec.AccessControl
+	AccessControlSet bool
+}
+
+func (s *Server) patchAdminDevice(w http.ResponseWriter, r *http.Request) {
+	network := r.PathValue("network")
+	device := r.PathValue("device")
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	var req PatchAdminDeviceRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	nI, ok := s.spec.GetNetworkIndex(network)
+	if !ok {
+		http.Error(w, "network not found", 404)
+		return
+	}
+	sndI, ok := s.spec.Networks[nI].GetDeviceIndex(device)
+	if !ok {
+		http.Error(w, "device not found", 404)
+		return
+	}
+	newSpec := s.spec.Clone()
+	snd := &newSpec.Networks[nI].Devices[sndI]
+	if req.EndpointsSet {
+		snd.Endpoints = req.Endpoints
+	}
+	if req.AddressesSet {
+		snd.Addresses = req.Addresses
+	}
+	if req.AccessControlSet {
+		snd.AccessControl = req.AccessControl
+	}
+	// allocate new addresses if Addresses was cleared
+	err := newSpec.Networks[nI].AssignAddresses()
+	if err != nil {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	err = newSpec.Networks[nI].Validate()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	err = s.updateSpecNoLock(newSpec)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("patched device %s/%s.", network, device)
+	w.WriteHeader(204)
+}
+
+func (s *Server) deleteAdminDevice(w http.ResponseWriter, r *http.Request) {
+	network := r.PathValue("network")
+	device := r.PathValue("device")
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	nI, ok := s.spec.GetNetworkIndex(network)
+	if !ok {
+		http.Error(w, "network not found", 404)
+		return
+	}
+	sndI, ok := s.spec.Networks[nI].GetDeviceIndex(device)
+	if !ok {
+		http.Error(w, "device not found", 404)
+		return
+	}
+	newSpec := s.spec.Clone()
+	removeDevice(&newSpec.Networks[nI], sndI)
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	err := s.updateSpecNoLock(newSpec)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("removed device %s/%s.", network, device)
+	w.WriteHeader(204)
+}
+
+type GetAdminDevicePeersResponse struct {
+	// Peers is the endpoint or forwarder the device last reported choosing for each peer.
+	Peers []PeerChoice
+}
+
+func (s *Server) getAdminDevicePeers(w http.ResponseWriter, r *http.Request) {
+	network := r.PathValue("network")
+	device := r.PathValue("device")
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	s.specLock.RLock()
+	defer s.specLock.RUnlock()
+	sn, ok := s.spec.GetNetwork(network)
+	if !ok {
+		http.Error(w, "network not found", 404)
+		return
+	}
+	if _, ok := sn.GetDevice(device); !ok {
+		http.Error(w, "device not found", 404)
+		return
+	}
+	s.latestLock.RLock()
+	peers := s.peers[network][device]
+	s.latestLock.RUnlock()
+	data, err := json.Marshal(GetAdminDevicePeersResponse{Peers: peers})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+// removeDevice removes the i-th device from sn, along with references to it in other devices' AccessOnly and Accessible.
+func removeDevice(sn *spec.Network, i int) {
+	device := sn.Devices[i].Name
+	sn.Devices = slices.Delete(sn.Devices, i, i+1)
+	for i := range sn.Devices {
+		snd := &sn.Devices[i]
+		snd.AccessOnly = slices.DeleteFunc(snd.AccessOnly, func(name string) bool { return name == device })
+		snd.Accessible = slices.DeleteFunc(snd.Accessible, func(name string) bool { return name == device })
+	}
+}
@@ -0,0 +1,158 @@
+package coord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
+	"github.com/nyiyui/qrystal/util"
+	"go.uber.org/zap"
+)
+
+// EnrollInfo specifies the device created when an enrollment token is used.
+// An enrollment token can only be used once; it is revoked after the device is created.
+type EnrollInfo struct {
+	// Network is the network the device is created in.
+	Network string
+	// AddressPools are the IP networks the device's addresses are allocated from.
+	// One address is allocated from each pool.
+	// Leave empty to use the network's AddressRanges.
+	AddressPools []goal.IPNet
+	// AccessControl is the created device's AccessControl.
+	AccessControl spec.AccessControl
+	// Scopes is the list of scopes of the token issued for the created device.
+	// Leave empty for ScopeReifyRead and ScopeReifyPatch.
+	Scopes []Scope
+}
+
+// Validate checks that the EnrollInfo is well-formed.
+func (ei EnrollInfo) Validate() error {
+	if ei.Network == "" {
+		return errors.New("Network must not be blank")
+	}
+	if slices.Contains(ei.Scopes, ScopeAdmin) {
+		return errors.New("Scopes must not contain admin")
+	}
+	return TokenInfo{Scopes: ei.Scopes}.Validate()
+}
+
+// ErrEnrollWithoutStore is returned when enrollment tokens are used without a Store.
+// Used enrollment tokens are revoked, and the revocation must be saved so that they cannot be used again after a restart.
+var ErrEnrollWithoutStore = errors.New("enrollment tokens require a store")
+
+// HasEnrollTokens returns whether any of the tokens is an enrollment token.
+func HasEnrollTokens(tokens map[util.TokenHash]TokenInfo) bool {
+	for _, tokenInfo := range tokens {
+		if tokenInfo.Enroll != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type EnrollResponse struct {
+	// Token identifies as the created device.
+	Token *util.Token
+}
+
+func (s *Server) postEnroll(w http.ResponseWriter, r *http.Request) {
+	network := r.PathValue("network")
+	device := r.PathValue("device")
+	enrollHash, tokenInfo, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if tokenInfo.Enroll == nil || tokenInfo.Enroll.Network != network {
+		http.Error(w, "not an enrollment token for this network", 403)
+		return
+	}
+	if device == "" {
+		http.Error(w, "device name must not be blank", 400)
+		return
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	if s.store == nil {
+		http.Error(w, ErrEnrollWithoutStore.Error(), 409)
+		return
+	}
+	nI, ok := s.spec.GetNetworkIndex(network)
+	if !ok {
+		http.Error(w, "network not found", 404)
+		return
+	}
+	if _, ok := s.spec.Networks[nI].GetDevice(device); ok {
+		http.Error(w, "device already exists", 409)
+		return
+	}
+	pools := tokenInfo.Enroll.AddressPools
+	if len(pools) == 0 {
+		pools = s.spec.Networks[nI].AddressRanges
+	}
+	if len(pools) == 0 {
+		http.Error(w, "enrollment token has no AddressPools, and network has no AddressRanges", 409)
+		return
+	}
+	addresses, err := s.spec.Networks[nI].AllocateAddresses(pools)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("allocating addresses: %s", err), 409)
+		return
+	}
+	newSpec := s.spec.Clone()
+	snd := spec.NetworkDevice{
+		NetworkDeviceCensored: spec.NetworkDeviceCensored{
+			Name:      device,
+			Addresses: addresses,
+		},
+		AccessControl: tokenInfo.Enroll.AccessControl.Clone(),
+	}
+	newSpec.Networks[nI].Devices = append(newSpec.Networks[nI].Devices, snd)
+	err = newSpec.Networks[nI].Validate()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	token, err := util.RandomToken()
+	if err != nil {
+		http.Error(w, "generating token failed", 500)
+		return
+	}
+	s.tokensLock.Lock()
+	if _, revoked := s.revoked[enrollHash]; revoked {
+		// used concurrently by another request
+		s.tokensLock.Unlock()
+		http.Error(w, "token revoked", 401)
+		return
+	}
+	s.revoked[enrollHash] = struct{}{}
+	s.issued[*token.Hash()] = TokenInfo{
+		Identities: [][2]string{{network, device}},
+		Scopes:     tokenInfo.Enroll.Scopes,
+	}
+	s.tokensLock.Unlock()
+	// this also saves the revoked and issued tokens
+	err = s.updateSpecNoLock(newSpec)
+	if err != nil {
+		s.tokensLock.Lock()
+		delete(s.revoked, enrollHash)
+		delete(s.issued, *token.Hash())
+		s.tokensLock.Unlock()
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("enrolled device %s/%s with addresses %v.", network, device, addresses)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	err = json.NewEncoder(w).Encode(EnrollResponse{Token: token})
+	if err != nil {
+		zap.S().Errorf("json encode and HTTP write of EnrollResponse failed: %s", err)
+	}
+}
@@ -0,0 +1,57 @@
+package coord
+
+import (
+	"fmt"
+
+	"github.com/nyiyui/qrystal/spec"
+	"github.com/nyiyui/qrystal/util"
+	"go.uber.org/zap"
+)
+
+// Reload replaces the static spec and tokens (i.e. the ones given to NewServer) with the given ones.
+// Fields set by devices, as well as networks and devices added at runtime, are kept, like when loading from a store (see mergeSpec).
+// Networks and devices that were in the previous static spec but are not in static are removed.
+// Networks and devices in both static specs that were removed at runtime (using the admin API) stay removed.
+// Fields of static devices edited at runtime are kept, unless they were also changed in static (see keepEdited).
+// If static is invalid, Reload returns an error and nothing is changed.
+func (s *Server) Reload(static spec.Spec, tokens map[util.TokenHash]TokenInfo) error {
+	if tokens == nil {
+		panic("coord.Server.Reload: tokens map must not be nil")
+	}
+	err := static.Validate()
+	if err != nil {
+		return fmt.Errorf("spec is invalid:\n%w", err)
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	if s.store == nil && HasEnrollTokens(tokens) {
+		return ErrEnrollWithoutStore
+	}
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	current := s.spec.Clone()
+	removeStatic(&current, s.static, static)
+	merged := mergeSpec(static, current)
+	removeDeleted(&merged, s.static, static, current)
+	keepEdited(&merged, s.static, static, current)
+	err = merged.AssignAddresses()
+	if err != nil {
+		return fmt.Errorf("assigning addresses: %w", err)
+	}
+	err = merged.Validate()
+	if err != nil {
+		return fmt.Errorf("spec merged with current spec is invalid:\n%w", err)
+	}
+	prevStatic := s.static
+	s.static = static.Clone()
+	err = s.updateSpecNoLock(merged)
+	if err != nil {
+		s.static = prevStatic
+		return err
+	}
+	s.tokensLock.Lock()
+	s.tokens = tokens
+	s.tokensLock.Unlock()
+	zap.S().Infof("reloaded spec and %d token(s).", len(tokens))
+	return nil
+}
@@ -0,0 +1,72 @@
+package coord
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nyiyui/qrystal/spec"
+	"github.com/nyiyui/qrystal/util"
+)
+
+func TestReload(t *testing.T) {
+	s, token := newTestServer(t)
+	publicKey := mustGenerateKey(t)
+	newSpec := s.spec.Clone()
+	newSpec.Networks[0].Devices[0].PublicKey = publicKey
+	err := s.updateSpec(newSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newToken, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	static := spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a"}, AccessControl: spec.AccessControl{AccessAll: true}},
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "c"}, AccessControl: spec.AccessControl{AccessAll: true}},
+		},
+	}}}
+	tokens := map[util.TokenHash]TokenInfo{*newToken.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}}}
+
+	invalid := static.Clone()
+	invalid.Networks[0].Devices[1].Name = "a"
+	err = s.Reload(invalid, tokens)
+	if err == nil {
+		t.Fatal("reload with invalid spec succeeded")
+	}
+	if _, ok := s.spec.Networks[0].GetDevice("b"); !ok {
+		t.Fatal("failed reload changed the spec")
+	}
+
+	err = s.Reload(static, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := s.spec.Networks[0]
+	if snd, ok := sn.GetDevice("a"); !ok || snd.PublicKey != publicKey {
+		t.Fatalf("public key set by device was not kept: %#v", sn.Devices)
+	}
+	if _, ok := sn.GetDevice("b"); ok {
+		t.Fatal("device removed from static spec was kept")
+	}
+	if _, ok := sn.GetDevice("c"); !ok {
+		t.Fatal("device added to static spec is missing")
+	}
+
+	do := func(token *util.Token) int {
+		r := httptest.NewRequest("GET", "/v1/reify/qrystal0/a/spec", nil)
+		r.Header.Set("Authorization", "QrystalCoordIdentityToken "+token.String())
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := do(token); code != 401 {
+		t.Fatalf("token removed by reload: unexpected status %d", code)
+	}
+	if code := do(newToken); code != 200 {
+		t.Fatalf("token added by reload: unexpected status %d", code)
+	}
+}
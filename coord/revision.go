@@ -0,0 +1,57 @@
+package coord
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/nyiyui/qrystal/spec"
+)
+
+// RevisionETag returns the ETag for the given spec revision.
+func RevisionETag(revision uint64) string {
+	return `"` + strconv.FormatUint(revision, 10) + `"`
+}
+
+// ParseRevisionETag parses an ETag (or an If-Match header with a single ETag) returned by RevisionETag.
+func ParseRevisionETag(etag string) (revision uint64, ok bool) {
+	etag = strings.TrimSpace(etag)
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	revision, err := strconv.ParseUint(etag[1:len(etag)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return revision, true
+}
+
+// updateRevisions increments the revision of each device whose view of its network (see spec.Network.CensorForDevice) differs between oldSpec and newSpec.
+// revisions is indexed by network, then device.
+// Devices without a revision get their first revision (1).
+// Revisions of removed networks and devices are kept, so that a network or device re-added with the same name does not reuse revisions.
+func updateRevisions(revisions map[string]map[string]uint64, oldSpec, newSpec spec.Spec) {
+	for _, newSN := range newSpec.Networks {
+		if revisions[newSN.Name] == nil {
+			revisions[newSN.Name] = map[string]uint64{}
+		}
+		oldSN, ok := oldSpec.GetNetwork(newSN.Name)
+		for _, newSND := range newSN.Devices {
+			if revisions[newSN.Name][newSND.Name] != 0 && ok {
+				if _, ok := oldSN.GetDevice(newSND.Name); ok && oldSN.CensorForDevice(newSND.Name).Equal(newSN.CensorForDevice(newSND.Name)) {
+					continue
+				}
+			}
+			revisions[newSN.Name][newSND.Name]++
+		}
+	}
+}
+
+// cloneRevisions returns a deep copy of revisions.
+func cloneRevisions(revisions map[string]map[string]uint64) map[string]map[string]uint64 {
+	clone := make(map[string]map[string]uint64, len(revisions))
+	for network, deviceRevisions := range revisions {
+		clone[network] = maps.Clone(deviceRevisions)
+	}
+	return clone
+}
@@ -6,8 +6,8 @@ import (
 	"io"
 	"net/http"
 	"slices"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/nyiyui/qrystal/goal"
@@ -16,19 +16,39 @@ import (
 	"go.uber.org/zap"
 )
 
-type TokenInfo struct {
-	Identities [][2]string
-}
-
 type Server struct {
-	mux      *http.ServeMux
-	spec     spec.Spec
+	mux  *http.ServeMux
+	spec spec.Spec
+	// static is the spec given to NewServer or Reload, before merging with changes made at runtime.
+	// This is protected by specLock.
+	static   spec.Spec
 	specLock sync.RWMutex
 	// latest lists which devices have applied the latest spec.
 	// The key is the network name, and the value is the list of device names.
 	latest     map[string][]string
 	latestLock sync.RWMutex
-	tokens     map[util.TokenHash]TokenInfo
+	// specChanged is closed (and replaced with a new channel) when spec is changed.
+	// This is protected by latestLock.
+	specChanged chan struct{}
+	// peers is the endpoint or forwarder each device last reported choosing for its peers (see PostReifyStatusRequest.Peers).
+	// The keys are the network name, then the device name.
+	// This is protected by latestLock.
+	peers  map[string]map[string][]PeerChoice
+	tokens map[util.TokenHash]TokenInfo
+	// issued is the tokens issued at runtime (e.g. by enrollment).
+	// Unlike tokens, these are saved to store.
+	issued map[util.TokenHash]TokenInfo
+	// revoked is the set of revoked tokens.
+	// Revoked tokens are rejected even if they are in tokens.
+	revoked    map[util.TokenHash]struct{}
+	tokensLock sync.RWMutex
+	// revisions is the latest revision of each device's view of each network (indexed by network, then device).
+	// A device's revision is incremented every time its view of the network (see spec.Network.CensorForDevice) is changed.
+	// This is protected by specLock.
+	revisions map[string]map[string]uint64
+	// store persists spec across restarts.
+	// If store is nil, spec is only kept in memory.
+	store Store
 }
 
 func NewServer(spec spec.Spec, tokens map[util.TokenHash]TokenInfo) *Server {
@@ -36,11 +56,18 @@ func NewServer(spec spec.Spec, tokens map[util.TokenHash]TokenInfo) *Server {
 		panic("coord.NewServer: tokens map must not be nil")
 	}
 	s := &Server{
-		mux:    http.NewServeMux(),
-		spec:   spec,
-		latest: map[string][]string{},
-		tokens: tokens,
+		mux:         http.NewServeMux(),
+		spec:        spec,
+		static:      spec.Clone(),
+		latest:      map[string][]string{},
+		specChanged: make(chan struct{}),
+		peers:       map[string]map[string][]PeerChoice{},
+		tokens:      tokens,
+		issued:      map[util.TokenHash]TokenInfo{},
+		revoked:     map[util.TokenHash]struct{}{},
+		revisions:   map[string]map[string]uint64{},
 	}
+	updateRevisions(s.revisions, spec, spec)
 	s.setup()
 	return s
 }
@@ -54,76 +81,99 @@ func (s *Server) setup() {
 	s.mux.HandleFunc("GET /v1/reify/{network}/{device}/spec", s.getReifySpec)
 	s.mux.HandleFunc("PATCH /v1/reify/{network}/{device}/spec", s.patchReifySpec)
 	s.mux.HandleFunc("POST /v1/reify/{network}/{device}/status", s.postReifyStatus)
-}
-
-// verifyIdentity verifies if the given request has the credentials to identify as the given network device.
-// If this returns true, continue with the request.
-// If this returns false, abort the request.
-func (s *Server) verifyIdentity(w http.ResponseWriter, r *http.Request, network, device string) (ok bool) {
-	const prefix = "QrystalCoordIdentityToken "
-	header := r.Header.Get("Authorization")
-	if !strings.HasPrefix(header, prefix) {
-		http.Error(w, "Authorization header must have type QrystalCoordIdentityToken", 401)
-		return false
-	}
-	token, err := util.ParseToken(strings.TrimPrefix(header, prefix))
-	if err != nil {
-		http.Error(w, "bad token", 401)
-		return false
-	}
-	tokenHash := token.Hash()
-	tokenInfo, ok := s.tokens[*tokenHash]
-	if !ok {
-		http.Error(w, "not authorized", 401)
-		return false
-	}
-	if !slices.Contains(tokenInfo.Identities, [2]string{network, device}) {
-		http.Error(w, "not authorized", 401)
-		return false
-	}
-	return true
+	s.mux.HandleFunc("POST /v1/enroll/{network}/{device}", s.postEnroll)
+	s.setupAdmin()
 }
 
 type GetReifyLatestResponse struct {
 	Latest bool
 }
 
+// maxLatestWait is the maximum duration a GET /v1/reify/{network}/{device}/latest request can wait for.
+const maxLatestWait = 10 * time.Minute
+
+// LatestWaitHeader is set on responses to GET /v1/reify/{network}/{device}/latest to the duration the server waited for (at most).
+// Clients can use the absence of this header to detect servers that do not support long-polling.
+const LatestWaitHeader = "Qrystal-Latest-Wait"
+
 func (s *Server) getReifyLatest(w http.ResponseWriter, r *http.Request) {
 	network := r.PathValue("network")
 	device := r.PathValue("device")
-	if !s.verifyIdentity(w, r, network, device) {
+	if !s.verifyIdentity(w, r, network, device, ScopeReifyRead) {
 		return
 	}
-	s.specLock.RLock()
-	defer s.specLock.RUnlock()
-	{
-		sn, ok := s.spec.GetNetwork(network)
+	var wait time.Duration
+	if raw := r.URL.Query().Get("wait"); raw != "" {
+		var err error
+		wait, err = time.ParseDuration(raw)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("parsing wait: %s", err), 400)
+			return
+		}
+		if wait < 0 || wait > maxLatestWait {
+			http.Error(w, fmt.Sprintf("wait must be between 0 and %s", maxLatestWait), 400)
+			return
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var latest bool
+Wait:
+	for {
+		var changed <-chan struct{}
+		var ok bool
+		latest, changed, ok = s.isLatest(w, network, device)
 		if !ok {
-			http.Error(w, "network not found", 404)
 			return
 		}
-		if _, ok = sn.GetDevice(device); !ok {
-			http.Error(w, "device not found", 404)
+		if !latest || wait == 0 {
+			break
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			break Wait
+		case <-r.Context().Done():
 			return
 		}
 	}
-	s.latestLock.RLock()
-	defer s.latestLock.RUnlock()
 	var response string
-	if slices.Contains(s.latest[network], device) {
+	if latest {
 		response = `{"Latest":true}`
 	} else {
 		response = `{"Latest":false}`
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(LatestWaitHeader, wait.String())
 	w.WriteHeader(200)
 	w.Write([]byte(response))
 }
 
+// isLatest returns whether the given device has applied the latest spec, and a channel that is closed when the spec is changed next.
+// If this returns false for ok, an error has been written to w, and the request should be aborted.
+func (s *Server) isLatest(w http.ResponseWriter, network, device string) (latest bool, changed <-chan struct{}, ok bool) {
+	s.specLock.RLock()
+	defer s.specLock.RUnlock()
+	{
+		sn, ok := s.spec.GetNetwork(network)
+		if !ok {
+			http.Error(w, "network not found", 404)
+			return false, nil, false
+		}
+		if _, ok = sn.GetDevice(device); !ok {
+			http.Error(w, "device not found", 404)
+			return false, nil, false
+		}
+	}
+	s.latestLock.RLock()
+	defer s.latestLock.RUnlock()
+	return slices.Contains(s.latest[network], device), s.specChanged, true
+}
+
 func (s *Server) getReifySpec(w http.ResponseWriter, r *http.Request) {
 	network := r.PathValue("network")
 	device := r.PathValue("device")
-	if !s.verifyIdentity(w, r, network, device) {
+	if !s.verifyIdentity(w, r, network, device, ScopeReifyRead) {
 		return
 	}
 	s.specLock.RLock()
@@ -145,6 +195,8 @@ func (s *Server) getReifySpec(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		panic(err)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", RevisionETag(s.revisions[network][device]))
 	w.WriteHeader(200)
 	w.Write(data)
 }
@@ -167,7 +219,7 @@ type PatchReifySpecRequest struct {
 func (s *Server) patchReifySpec(w http.ResponseWriter, r *http.Request) {
 	network := r.PathValue("network")
 	device := r.PathValue("device")
-	if !s.verifyIdentity(w, r, network, device) {
+	if !s.verifyIdentity(w, r, network, device, ScopeReifyPatch) {
 		return
 	}
 	s.specLock.Lock()
@@ -183,6 +235,17 @@ func (s *Server) patchReifySpec(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		revision, ok := ParseRevisionETag(ifMatch)
+		if !ok {
+			http.Error(w, "If-Match must be a single ETag returned by GET", 400)
+			return
+		}
+		if revision != s.revisions[network][device] {
+			http.Error(w, "spec was changed since the given revision", 412)
+			return
+		}
+	}
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read request body", 500)
@@ -219,20 +282,48 @@ func (s *Server) patchReifySpec(w http.ResponseWriter, r *http.Request) {
 		zap.S().Debugf("setting Accessible to %v", req.Accessible)
 		newSpec.Networks[nI].Devices[sndI].Accessible = req.Accessible
 	}
+	err = newSpec.Networks[nI].Validate()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
 	s.latestLock.Lock()
 	defer s.latestLock.Unlock()
-	s.updateSpecNoLock(newSpec)
+	err = s.updateSpecNoLock(newSpec)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
 	data, err = json.Marshal(s.spec.Networks[nI].Devices[sndI])
 	if err != nil {
 		panic(err)
 	}
 	zap.S().Infof("patched %s/%s:\n%s", network, device, data)
+	w.Header().Set("ETag", RevisionETag(s.revisions[network][device]))
 	w.WriteHeader(204)
 	return
 }
 
 type PostReifyStatusRequest struct {
-	Reified spec.NetworkCensored
+	// Revision is the revision (see GET /v1/reify/{network}/{device}/spec's ETag) of the applied spec.
+	// Set to 0 to use Reified instead.
+	Revision uint64
+	// Reified is the applied spec.
+	// This is only used if Revision is 0.
+	Reified *spec.NetworkCensored
+	// Peers is the endpoint or forwarder chosen for each peer.
+	// If nil, the choices reported before are kept.
+	Peers []PeerChoice
+}
+
+// PeerChoice is how a device reaches one of its peers.
+type PeerChoice struct {
+	// Peer is the name of the peer.
+	Peer string
+	// Endpoint is the address of the endpoint chosen, if any.
+	Endpoint string `json:",omitempty"`
+	// Forwarder is the name of the device forwarding to the peer, if any.
+	Forwarder string `json:",omitempty"`
 }
 
 type PostReifyStatusResponse struct {
@@ -242,7 +333,7 @@ type PostReifyStatusResponse struct {
 func (s *Server) postReifyStatus(w http.ResponseWriter, r *http.Request) {
 	network := r.PathValue("network")
 	device := r.PathValue("device")
-	if !s.verifyIdentity(w, r, network, device) {
+	if !s.verifyIdentity(w, r, network, device, ScopeReifyRead) {
 		return
 	}
 	s.specLock.Lock()
@@ -262,14 +353,37 @@ func (s *Server) postReifyStatus(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("request data read or json decode failed: %s", err), 400)
+		return
 	}
 	nI, ok := s.spec.GetNetworkIndex(network)
 	if !ok {
 		http.Error(w, "invalid request data", 422)
 		return
 	}
-	if !req.Reified.Equal(s.spec.Networks[nI].CensorForDevice(device)) {
-		zap.S().Infof("given network does not match mine (mine minus given):\n%s", cmp.Diff(req.Reified, s.spec.Networks[nI].CensorForDevice(device)))
+	if req.Peers != nil {
+		s.latestLock.Lock()
+		if s.peers[network] == nil {
+			s.peers[network] = map[string][]PeerChoice{}
+		}
+		s.peers[network][device] = req.Peers
+		s.latestLock.Unlock()
+	}
+	if req.Revision != 0 {
+		if req.Revision != s.revisions[network][device] {
+			zap.S().Infof("given revision %d does not match mine (%d)", req.Revision, s.revisions[network][device])
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			err := json.NewEncoder(w).Encode(PostReifyStatusResponse{false})
+			if err != nil {
+				zap.S().Error("json encode and HTTP write of PostReifyStatusResponse failed: %s", err)
+			}
+			return
+		}
+	} else if req.Reified == nil {
+		http.Error(w, "one of Revision or Reified must be set", 422)
+		return
+	} else if !req.Reified.Equal(s.spec.Networks[nI].CensorForDevice(device)) {
+		zap.S().Infof("given network does not match mine (mine minus given):\n%s", cmp.Diff(*req.Reified, s.spec.Networks[nI].CensorForDevice(device)))
 		data, _ := json.Marshal(req.Reified)
 		zap.S().Infof("given network:\n%s", data)
 		data, _ = json.Marshal(s.spec.Networks[nI].CensorForDevice(device))
@@ -288,7 +402,9 @@ func (s *Server) postReifyStatus(w http.ResponseWriter, r *http.Request) {
 	if s.latest == nil {
 		s.latest = map[string][]string{}
 	}
-	s.latest[network] = append(s.latest[network], device)
+	if !slices.Contains(s.latest[network], device) {
+		s.latest[network] = append(s.latest[network], device)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
 	err = json.NewEncoder(w).Encode(PostReifyStatusResponse{true})
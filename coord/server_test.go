@@ -0,0 +1,340 @@
+package coord
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
+	"github.com/nyiyui/qrystal/util"
+)
+
+func newTestServer(t *testing.T) (*Server, *util.Token) {
+	token, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a"}, AccessControl: spec.AccessControl{AccessAll: true}},
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "b"}, AccessControl: spec.AccessControl{AccessAll: true}},
+		},
+	}}}, map[util.TokenHash]TokenInfo{
+		*token.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}},
+	})
+	return s, token
+}
+
+func TestGetReifyLatestWait(t *testing.T) {
+	s, token := newTestServer(t)
+	s.latest["qrystal0"] = []string{"a"}
+
+	type result struct {
+		latest  bool
+		elapsed time.Duration
+	}
+	results := make(chan result)
+	go func() {
+		start := time.Now()
+		r := httptest.NewRequest("GET", "/v1/reify/qrystal0/a/latest?wait=10s", nil)
+		r.Header.Set("Authorization", "QrystalCoordIdentityToken "+token.String())
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("unexpected status %d: %s", w.Code, w.Body)
+		}
+		if w.Header().Get(LatestWaitHeader) == "" {
+			t.Errorf("%s header missing", LatestWaitHeader)
+		}
+		var resp GetReifyLatestResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- result{resp.Latest, time.Since(start)}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	newSpec := s.spec.Clone()
+	newSpec.Networks[0].Devices[1].ListenPort = 51820
+	err := s.updateSpec(newSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-results
+	if res.latest {
+		t.Fatal("still latest after spec change")
+	}
+	if res.elapsed > 5*time.Second {
+		t.Fatalf("response took %s; should have returned right after the spec change", res.elapsed)
+	}
+}
+
+func TestRevision(t *testing.T) {
+	s, token := newTestServer(t)
+	do := func(method, path, ifMatch, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "QrystalCoordIdentityToken "+token.String())
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	w := do("GET", "/v1/reify/qrystal0/a/spec", "", "")
+	etag := w.Header().Get("ETag")
+	revision, ok := ParseRevisionETag(etag)
+	if !ok {
+		t.Fatalf("GET spec returned invalid ETag %q", etag)
+	}
+
+	w = do("PATCH", "/v1/reify/qrystal0/a/spec", etag, `{"ListenPort":51820,"ListenPortSet":true}`)
+	if w.Code != 204 {
+		t.Fatalf("PATCH with current revision: unexpected status %d: %s", w.Code, w.Body)
+	}
+	newRevision, ok := ParseRevisionETag(w.Header().Get("ETag"))
+	if !ok || newRevision <= revision {
+		t.Fatalf("PATCH did not increment revision: %d → %d", revision, newRevision)
+	}
+
+	w = do("PATCH", "/v1/reify/qrystal0/a/spec", etag, `{"ListenPort":51821,"ListenPortSet":true}`)
+	if w.Code != 412 {
+		t.Fatalf("PATCH with stale revision: unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	w = do("POST", "/v1/reify/qrystal0/a/status", "", fmt.Sprintf(`{"Revision":%d}`, revision))
+	var resp PostReifyStatusResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Latest {
+		t.Fatal("stale revision reported as latest")
+	}
+	w = do("POST", "/v1/reify/qrystal0/a/status", "", fmt.Sprintf(`{"Revision":%d}`, newRevision))
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !resp.Latest {
+		t.Fatalf("current revision not reported as latest: %s", w.Body)
+	}
+
+	// changes outside of a's view do not change a's revision
+	newSpec := s.spec.Clone()
+	newSpec.Networks[0].Devices[0].AccessControl = spec.AccessControl{AccessOnly: []string{"a"}}
+	err := s.updateSpec(newSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revision, revisionB := s.revisions["qrystal0"]["a"], s.revisions["qrystal0"]["b"]
+	newSpec = s.spec.Clone()
+	newSpec.Networks[0].Devices[1].ListenPort = 51821
+	err = s.updateSpec(newSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.revisions["qrystal0"]["b"] == revisionB {
+		t.Fatal("revision of b not incremented")
+	}
+	w = do("POST", "/v1/reify/qrystal0/a/status", "", fmt.Sprintf(`{"Revision":%d}`, revision))
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if !resp.Latest {
+		t.Fatalf("revision of a changed by a change to b: %s", w.Body)
+	}
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	s, token := newTestServer(t)
+	admin, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tokens[*admin.Hash()] = TokenInfo{Scopes: []Scope{ScopeAdmin}}
+	s.tokens[*readOnly.Hash()] = TokenInfo{Identities: [][2]string{{"qrystal0", "a"}}, Scopes: []Scope{ScopeReifyRead}}
+	s.tokens[*expired.Hash()] = TokenInfo{Identities: [][2]string{{"qrystal0", "a"}}, NotAfter: time.Now().Add(-time.Hour)}
+	do := func(token *util.Token, method, path, body string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "QrystalCoordIdentityToken "+token.String())
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := do(readOnly, "GET", "/v1/reify/qrystal0/a/spec", ""); code != 200 {
+		t.Fatalf("read-only token GET spec: unexpected status %d", code)
+	}
+	if code := do(readOnly, "PATCH", "/v1/reify/qrystal0/a/spec", `{}`); code != 403 {
+		t.Fatalf("read-only token PATCH spec: unexpected status %d", code)
+	}
+	if code := do(expired, "GET", "/v1/reify/qrystal0/a/spec", ""); code != 401 {
+		t.Fatalf("expired token GET spec: unexpected status %d", code)
+	}
+	if code := do(token, "GET", "/v1/admin/spec", ""); code != 403 {
+		t.Fatalf("non-admin token GET admin spec: unexpected status %d", code)
+	}
+	if code := do(admin, "POST", "/v1/admin/tokens/revoked", fmt.Sprintf(`{"Hash":"%s"}`, token.Hash())); code != 204 {
+		t.Fatalf("revoke: unexpected status %d", code)
+	}
+	if code := do(token, "GET", "/v1/reify/qrystal0/a/spec", ""); code != 401 {
+		t.Fatalf("revoked token GET spec: unexpected status %d", code)
+	}
+	if code := do(admin, "DELETE", "/v1/admin/tokens/revoked/"+token.Hash().String(), ""); code != 204 {
+		t.Fatalf("unrevoke: unexpected status %d", code)
+	}
+	if code := do(token, "GET", "/v1/reify/qrystal0/a/spec", ""); code != 200 {
+		t.Fatalf("unrevoked token GET spec: unexpected status %d", code)
+	}
+}
+
+func TestPeerChoices(t *testing.T) {
+	s, token := newTestServer(t)
+	admin, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tokens[*admin.Hash()] = TokenInfo{Scopes: []Scope{ScopeAdmin}}
+	do := func(token *util.Token, method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "QrystalCoordIdentityToken "+token.String())
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	getPeers := func() []PeerChoice {
+		w := do(admin, "GET", "/v1/admin/networks/qrystal0/devices/a/peers", "")
+		if w.Code != 200 {
+			t.Fatalf("GET peers: unexpected status %d: %s", w.Code, w.Body)
+		}
+		var resp GetAdminDevicePeersResponse
+		err := json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Peers
+	}
+	if peers := getPeers(); len(peers) != 0 {
+		t.Fatalf("unexpected peers before report: %v", peers)
+	}
+
+	// choices are recorded even if the spec is not the latest
+	w := do(token, "POST", "/v1/reify/qrystal0/a/status", `{"Revision":1000,"Peers":[{"Peer":"b","Endpoint":"192.0.2.1:51820"}]}`)
+	if w.Code != 200 {
+		t.Fatalf("POST status: unexpected status %d: %s", w.Code, w.Body)
+	}
+	expected := []PeerChoice{{Peer: "b", Endpoint: "192.0.2.1:51820"}}
+	if peers := getPeers(); !slices.Equal(peers, expected) {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+	// not reporting choices keeps the previous ones
+	do(token, "POST", "/v1/reify/qrystal0/a/status", `{"Revision":1000}`)
+	if peers := getPeers(); !slices.Equal(peers, expected) {
+		t.Fatalf("unexpected peers after status without choices: %v", peers)
+	}
+
+	if code := do(admin, "DELETE", "/v1/admin/networks/qrystal0/devices/a", "").Code; code != 204 {
+		t.Fatalf("DELETE device: unexpected status %d", code)
+	}
+	if _, ok := s.peers["qrystal0"]["a"]; ok {
+		t.Fatal("choices of removed device kept")
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	s, _ := newTestServer(t)
+	enrollToken, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pool, _ := net.ParseCIDR("10.10.0.0/24")
+	s.tokens[*enrollToken.Hash()] = TokenInfo{Enroll: &EnrollInfo{
+		Network:       "qrystal0",
+		AddressPools:  []goal.IPNet{goal.IPNet(*pool)},
+		AccessControl: spec.AccessControl{AccessAll: true},
+	}}
+	if err := s.tokens[*enrollToken.Hash()].Validate(); err != nil {
+		t.Fatalf("valid enrollment token: %s", err)
+	}
+	if err := (TokenInfo{Scopes: []Scope{ScopeAdmin}, Enroll: &EnrollInfo{Network: "qrystal0"}}).Validate(); err == nil {
+		t.Fatal("enrollment token with scopes: expected error")
+	}
+	enroll := func(device string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/v1/enroll/qrystal0/"+device, nil)
+		r.Header.Set("Authorization", "QrystalCoordIdentityToken "+enrollToken.String())
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := enroll("laptop"); w.Code != 409 {
+		t.Fatalf("enroll without store: unexpected status %d: %s", w.Code, w.Body)
+	}
+	storePath := filepath.Join(t.TempDir(), "state.json")
+	err = s.SetStore(NewFileStore(storePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.spec.Networks[0].Devices[0].Addresses = []goal.IPNet{{IP: net.IPv4(10, 10, 0, 1).To4(), Mask: net.CIDRMask(32, 32)}}
+	w := enroll("laptop")
+	if w.Code != 200 {
+		t.Fatalf("enroll: unexpected status %d: %s", w.Code, w.Body)
+	}
+	var resp EnrollResponse
+	err = json.Unmarshal(w.Body.Bytes(), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snd, ok := s.spec.Networks[0].GetDevice("laptop")
+	if !ok {
+		t.Fatal("enrolled device not in spec")
+	}
+	if len(snd.Addresses) != 1 || !snd.Addresses[0].IP.Equal(net.IPv4(10, 10, 0, 2)) {
+		t.Fatalf("unexpected addresses %v, wanted [10.10.0.2/32]", snd.Addresses)
+	}
+
+	r := httptest.NewRequest("GET", "/v1/reify/qrystal0/laptop/spec", nil)
+	r.Header.Set("Authorization", "QrystalCoordIdentityToken "+resp.Token.String())
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("GET spec with issued token: unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	if w := enroll("laptop2"); w.Code != 401 {
+		t.Fatalf("enrollment token reused: unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	admin, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tokens[*admin.Hash()] = TokenInfo{Scopes: []Scope{ScopeAdmin}}
+	r = httptest.NewRequest("DELETE", "/v1/admin/tokens/revoked/"+enrollToken.Hash().String(), nil)
+	r.Header.Set("Authorization", "QrystalCoordIdentityToken "+admin.String())
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 409 {
+		t.Fatalf("unrevoke enrollment token: unexpected status %d: %s", w.Code, w.Body)
+	}
+
+	// the enrollment token stays revoked after a restart
+	s = NewServer(spec.Spec{Networks: []spec.Network{{Name: "qrystal0"}}}, s.tokens)
+	err = s.SetStore(NewFileStore(storePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := enroll("laptop2"); w.Code != 401 {
+		t.Fatalf("enrollment token reused after restart: unexpected status %d: %s", w.Code, w.Body)
+	}
+}
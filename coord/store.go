@@ -0,0 +1,309 @@
+package coord
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
+	"github.com/nyiyui/qrystal/util"
+)
+
+// State is the part of a Server that is persisted by a Store.
+type State struct {
+	Spec spec.Spec
+	// Static is the static spec (the one given to NewServer or Reload) the saved spec was merged with.
+	Static spec.Spec
+	// Revisions is the latest revision of each device's view of each network (indexed by network, then device).
+	Revisions map[string]map[string]uint64
+	// Revoked is the list of hashes of revoked tokens.
+	Revoked []string
+	// Issued is the tokens issued at runtime (e.g. by enrollment), keyed by their hashes.
+	Issued map[string]TokenInfo
+}
+
+// Store persists a Server's State across restarts.
+type Store interface {
+	// Load returns the last saved State.
+	// If no State has been saved yet, Load returns a zero State and a nil error.
+	Load() (State, error)
+	// Save persists the given State, replacing the previous one.
+	Save(State) error
+}
+
+// FileStore is a Store that saves the State as a JSON file.
+// The file is replaced atomically on every save, so a crash never leaves a partially written file behind.
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load implements Store.
+func (f *FileStore) Load() (State, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return State{}, nil
+	}
+	if err != nil {
+		return State{}, err
+	}
+	var state State
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return State{}, fmt.Errorf("parsing %s: %w", f.path, err)
+	}
+	return state, nil
+}
+
+// Save implements Store.
+func (f *FileStore) Save(state State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(f.path, data, 0600)
+}
+
+// SetStore sets the Store used to persist the spec, and loads the spec saved in it.
+// The spec given to NewServer is merged on top of the saved spec (see mergeSpec), and the result is saved back to the store.
+// Networks and devices removed from the static spec since the spec was saved are removed, ones removed using the admin API are not restored, and fields edited using the admin API are kept (see keepEdited).
+func (s *Server) SetStore(store Store) error {
+	state, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("loading state: %w", err)
+	}
+	revoked := map[util.TokenHash]struct{}{}
+	for _, raw := range state.Revoked {
+		tokenHash, err := util.ParseTokenHash(raw)
+		if err != nil {
+			return fmt.Errorf("parsing revoked token hash %s: %w", raw, err)
+		}
+		revoked[*tokenHash] = struct{}{}
+	}
+	issued := map[util.TokenHash]TokenInfo{}
+	for raw, tokenInfo := range state.Issued {
+		tokenHash, err := util.ParseTokenHash(raw)
+		if err != nil {
+			return fmt.Errorf("parsing issued token hash %s: %w", raw, err)
+		}
+		issued[*tokenHash] = tokenInfo
+	}
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	s.latestLock.Lock()
+	defer s.latestLock.Unlock()
+	stored := state.Spec.Clone()
+	removeStatic(&stored, state.Static, s.static)
+	merged := mergeSpec(s.static, stored)
+	removeDeleted(&merged, state.Static, s.static, stored)
+	keepEdited(&merged, state.Static, s.static, stored)
+	err = merged.AssignAddresses()
+	if err != nil {
+		return fmt.Errorf("assigning addresses: %w", err)
+	}
+	err = merged.Validate()
+	if err != nil {
+		return fmt.Errorf("spec merged with stored spec is invalid:\n%w", err)
+	}
+	s.store = store
+	s.tokensLock.Lock()
+	s.revoked = revoked
+	s.issued = issued
+	s.tokensLock.Unlock()
+	// continue from the saved revisions, so that devices that reported a saved revision are not mistaken to be up-to-date
+	revisions := cloneRevisions(state.Revisions)
+	updateRevisions(revisions, state.Spec, merged)
+	for network, deviceRevisions := range s.revisions {
+		if revisions[network] == nil {
+			revisions[network] = map[string]uint64{}
+		}
+		for device, revision := range deviceRevisions {
+			revisions[network][device] = max(revisions[network][device], revision)
+		}
+	}
+	return s.replaceSpecNoLock(merged, revisions)
+}
+
+// saveNoLock saves Server.spec (and other State) to Server.store, if any.
+// saveNoLock only takes Server.tokensLock.
+func (s *Server) saveNoLock() error {
+	return s.saveStateNoLock(s.spec, s.revisions)
+}
+
+// saveStateNoLock is like saveNoLock, but saves the given spec and revisions instead of Server.spec and Server.revisions.
+func (s *Server) saveStateNoLock(sp spec.Spec, revisions map[string]map[string]uint64) error {
+	if s.store == nil {
+		return nil
+	}
+	s.tokensLock.RLock()
+	revoked := s.revokedListNoLock()
+	issued := make(map[string]TokenInfo, len(s.issued))
+	for tokenHash, tokenInfo := range s.issued {
+		issued[tokenHash.String()] = tokenInfo
+	}
+	s.tokensLock.RUnlock()
+	return s.store.Save(State{Spec: sp, Static: s.static, Revisions: revisions, Revoked: revoked, Issued: issued})
+}
+
+// mergeSpec returns static with fields set by devices (see NetworkDeviceCensored) filled in from stored.
+// static is the source of truth: fields already set in static are kept as is.
+// Networks and devices only in stored (e.g. added using the admin API) are kept.
+func mergeSpec(static, stored spec.Spec) spec.Spec {
+	merged := static.Clone()
+	for _, storedSN := range stored.Networks {
+		if _, ok := merged.GetNetwork(storedSN.Name); !ok {
+			merged.Networks = append(merged.Networks, storedSN.Clone())
+		}
+	}
+	for i, sn := range merged.Networks {
+		storedSN, ok := stored.GetNetwork(sn.Name)
+		if !ok {
+			continue
+		}
+		for _, storedSND := range storedSN.Devices {
+			if _, ok := sn.GetDevice(storedSND.Name); !ok {
+				merged.Networks[i].Devices = append(merged.Networks[i].Devices, storedSND.Clone())
+			}
+		}
+		for j, snd := range sn.Devices {
+			storedSND, ok := storedSN.GetDevice(snd.Name)
+			if !ok {
+				continue
+			}
+			snd2 := &merged.Networks[i].Devices[j]
+			if snd2.ListenPort == 0 {
+				snd2.ListenPort = storedSND.ListenPort
+			}
+			if snd2.PublicKey == (goal.Key{}) {
+				snd2.PublicKey = storedSND.PublicKey
+			}
+			if snd2.PresharedKey == nil && storedSND.PresharedKey != nil {
+				presharedKey := *storedSND.PresharedKey
+				snd2.PresharedKey = &presharedKey
+			}
+			if snd2.PersistentKeepalive == 0 {
+				snd2.PersistentKeepalive = storedSND.PersistentKeepalive
+			}
+			if snd2.Accessible == nil {
+				snd2.Accessible = slices.Clone(storedSND.Accessible)
+			}
+			// keep addresses allocated from AddressRanges
+			if len(snd2.Addresses) == 0 {
+				snd2.Addresses = storedSND.Clone().Addresses
+			}
+		}
+	}
+	return merged
+}
+
+// removeStatic removes networks and devices in oldStatic but not in newStatic from current.
+func removeStatic(current *spec.Spec, oldStatic, newStatic spec.Spec) {
+	for _, oldSN := range oldStatic.Networks {
+		newSN, ok := newStatic.GetNetwork(oldSN.Name)
+		if !ok {
+			current.Networks = slices.DeleteFunc(current.Networks, func(sn spec.Network) bool { return sn.Name == oldSN.Name })
+			continue
+		}
+		nI, ok := current.GetNetworkIndex(oldSN.Name)
+		if !ok {
+			continue
+		}
+		for _, oldSND := range oldSN.Devices {
+			if _, ok := newSN.GetDevice(oldSND.Name); ok {
+				continue
+			}
+			if sndI, ok := current.Networks[nI].GetDeviceIndex(oldSND.Name); ok {
+				removeDevice(&current.Networks[nI], sndI)
+			}
+		}
+	}
+}
+
+// removeDeleted removes networks and devices in both oldStatic and newStatic, but not in current (i.e. removed at runtime), from merged.
+func removeDeleted(merged *spec.Spec, oldStatic, newStatic, current spec.Spec) {
+	for _, newSN := range newStatic.Networks {
+		oldSN, ok := oldStatic.GetNetwork(newSN.Name)
+		if !ok {
+			continue
+		}
+		currentSN, ok := current.GetNetwork(newSN.Name)
+		if !ok {
+			merged.Networks = slices.DeleteFunc(merged.Networks, func(sn spec.Network) bool { return sn.Name == newSN.Name })
+			continue
+		}
+		nI, ok := merged.GetNetworkIndex(newSN.Name)
+		if !ok {
+			continue
+		}
+		for _, newSND := range newSN.Devices {
+			if _, ok := oldSN.GetDevice(newSND.Name); !ok {
+				continue
+			}
+			if _, ok := currentSN.GetDevice(newSND.Name); ok {
+				continue
+			}
+			if sndI, ok := merged.Networks[nI].GetDeviceIndex(newSND.Name); ok {
+				removeDevice(&merged.Networks[nI], sndI)
+			}
+		}
+	}
+}
+
+// keepEdited sets fields that can be edited using the admin API (see PatchAdminDeviceRequest) of devices in oldStatic, newStatic and current to their values in current, if they were edited at runtime (i.e. differ between oldStatic and current) but not in the static spec (i.e. are the same in oldStatic and newStatic).
+func keepEdited(merged *spec.Spec, oldStatic, newStatic, current spec.Spec) {
+	for nI, sn := range merged.Networks {
+		oldSN, ok := oldStatic.GetNetwork(sn.Name)
+		if !ok {
+			continue
+		}
+		newSN, ok := newStatic.GetNetwork(sn.Name)
+		if !ok {
+			continue
+		}
+		currentSN, ok := current.GetNetwork(sn.Name)
+		if !ok {
+			continue
+		}
+		for sndI, snd := range sn.Devices {
+			oldSND, ok := oldSN.GetDevice(snd.Name)
+			if !ok {
+				continue
+			}
+			newSND, ok := newSN.GetDevice(snd.Name)
+			if !ok {
+				continue
+			}
+			currentSND, ok := currentSN.GetDevice(snd.Name)
+			if !ok {
+				continue
+			}
+			currentSND = currentSND.Clone()
+			merged2 := &merged.Networks[nI].Devices[sndI]
+			if endpointsEqual(oldSND.Endpoints, newSND.Endpoints) && !endpointsEqual(oldSND.Endpoints, currentSND.Endpoints) {
+				merged2.Endpoints = currentSND.Endpoints
+			}
+			if addressesEqual(oldSND.Addresses, newSND.Addresses) && !addressesEqual(oldSND.Addresses, currentSND.Addresses) {
+				merged2.Addresses = currentSND.Addresses
+			}
+			if oldSND.AccessControl.Equal(newSND.AccessControl) && !oldSND.AccessControl.Equal(currentSND.AccessControl) {
+				merged2.AccessControl = currentSND.AccessControl
+			}
+		}
+	}
+}
+
+func endpointsEqual(a, b []spec.Endpoint) bool {
+	return slices.EqualFunc(a, b, spec.Endpoint.Equal)
+}
+
+func addressesEqual(a, b []goal.IPNet) bool {
+	return slices.EqualFunc(a, b, func(a, b goal.IPNet) bool { return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask) })
+}
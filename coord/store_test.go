@@ -0,0 +1,200 @@
+package coord
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
+	"github.com/nyiyui/qrystal/util"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustGenerateKey(t *testing.T) goal.Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goal.Key(key.PublicKey())
+}
+
+func TestFileStore(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	state, err := store.Load()
+	if err != nil {
+		t.Fatalf("load before save: %s", err)
+	}
+	if len(state.Spec.Networks) != 0 {
+		t.Fatalf("load before save returned non-empty spec: %#v", state)
+	}
+	publicKey := mustGenerateKey(t)
+	s := spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a", PublicKey: publicKey, Accessible: []string{"b"}}, AccessControl: spec.AccessControl{AccessAll: true}},
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "b"}, AccessControl: spec.AccessControl{AccessAll: true}},
+		},
+	}}}
+	err = store.Save(State{Spec: s})
+	if err != nil {
+		t.Fatalf("save: %s", err)
+	}
+	state, err = store.Load()
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if !slices.EqualFunc(state.Spec.Networks[0].Devices, s.Networks[0].Devices, func(a, b spec.NetworkDevice) bool { return a.Equal(b) }) {
+		t.Fatalf("loaded spec differs from saved spec:\nloaded: %#v\nsaved: %#v", state.Spec, s)
+	}
+}
+
+func TestMergeSpec(t *testing.T) {
+	staticKey := mustGenerateKey(t)
+	storedKey := mustGenerateKey(t)
+	static := spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a"}},
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "b", PublicKey: staticKey}},
+		},
+	}}}
+	stored := spec.Spec{Networks: []spec.Network{
+		{
+			Name: "qrystal0",
+			Devices: []spec.NetworkDevice{
+				{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a", PublicKey: storedKey, ListenPort: 51820, Accessible: []string{"b"}}},
+				{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "b", PublicKey: storedKey}},
+				{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "c", PublicKey: storedKey}},
+			},
+		},
+		{Name: "removed"},
+	}}
+	// everything stored was in the static spec before
+	removeStatic(&stored, stored.Clone(), static)
+	merged := mergeSpec(static, stored)
+	if len(merged.Networks) != 1 {
+		t.Fatalf("networks not in static spec were kept: %#v", merged.Networks)
+	}
+	sn := merged.Networks[0]
+	if len(sn.Devices) != 2 {
+		t.Fatalf("devices not in static spec were kept: %#v", sn.Devices)
+	}
+	if sn.Devices[0].PublicKey != storedKey || sn.Devices[0].ListenPort != 51820 || !slices.Equal(sn.Devices[0].Accessible, []string{"b"}) {
+		t.Fatalf("fields set by device were not restored: %#v", sn.Devices[0])
+	}
+	if sn.Devices[1].PublicKey != staticKey {
+		t.Fatalf("static PublicKey was overwritten by stored one")
+	}
+}
+
+func TestSetStore(t *testing.T) {
+	device := func(name string) spec.NetworkDevice {
+		return spec.NetworkDevice{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: name}, AccessControl: spec.AccessControl{AccessAll: true}}
+	}
+	static := spec.Spec{Networks: []spec.Network{
+		{Name: "qrystal0", Devices: []spec.NetworkDevice{device("a"), device("b"), device("c")}},
+		{Name: "qrystal1", Devices: []spec.NetworkDevice{device("x")}},
+	}}
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	s := NewServer(static, map[util.TokenHash]TokenInfo{})
+	err := s.SetStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changes made at runtime (e.g. using the admin API)
+	newSpec := s.spec.Clone()
+	newSpec.Networks[0].Devices = append(newSpec.Networks[0].Devices, device("added"))
+	newSpec.Networks[0].Devices[0].Endpoints = []spec.Endpoint{{Address: "edited:51820"}}
+	removeDevice(&newSpec.Networks[0], 2)
+	newSpec.Networks = newSpec.Networks[:1]
+	err = s.updateSpec(newSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restart with b removed from the static spec
+	static2 := static.Clone()
+	removeDevice(&static2.Networks[0], 1)
+	s = NewServer(static2, map[util.TokenHash]TokenInfo{})
+	err = s.SetStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.spec.GetNetwork("qrystal1"); ok {
+		t.Fatal("network removed at runtime was restored")
+	}
+	sn := s.spec.Networks[0]
+	if _, ok := sn.GetDevice("a"); !ok {
+		t.Fatal("static device missing")
+	}
+	if _, ok := sn.GetDevice("b"); ok {
+		t.Fatal("device removed from static spec was kept")
+	}
+	if _, ok := sn.GetDevice("c"); ok {
+		t.Fatal("device removed at runtime was restored")
+	}
+	if _, ok := sn.GetDevice("added"); !ok {
+		t.Fatal("device added at runtime was not kept")
+	}
+	if snd, _ := sn.GetDevice("a"); len(snd.Endpoints) != 1 || snd.Endpoints[0].Address != "edited:51820" {
+		t.Fatalf("field edited at runtime was not kept: %v", snd.Endpoints)
+	}
+
+	// restart without changes keeps the revisions
+	revisions := cloneRevisions(s.revisions)
+	s = NewServer(static2, map[util.TokenHash]TokenInfo{})
+	err = s.SetStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.revisions, revisions) {
+		t.Fatalf("revisions changed from %v to %v", revisions, s.revisions)
+	}
+
+	// restart with the edited field changed in the static spec
+	static3 := static2.Clone()
+	static3.Networks[0].Devices[0].Endpoints = []spec.Endpoint{{Address: "static:51820"}}
+	s = NewServer(static3, map[util.TokenHash]TokenInfo{})
+	err = s.SetStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snd, _ := s.spec.Networks[0].GetDevice("a"); len(snd.Endpoints) != 1 || snd.Endpoints[0].Address != "static:51820" {
+		t.Fatalf("field changed in the static spec was not used: %v", snd.Endpoints)
+	}
+}
+
+// failingStore is a Store whose saves fail with err (if set).
+type failingStore struct {
+	err error
+}
+
+func (f *failingStore) Load() (State, error) { return State{}, nil }
+
+func (f *failingStore) Save(State) error { return f.err }
+
+func TestSaveFailure(t *testing.T) {
+	device := func(name string) spec.NetworkDevice {
+		return spec.NetworkDevice{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: name}, AccessControl: spec.AccessControl{AccessAll: true}}
+	}
+	s := NewServer(spec.Spec{Networks: []spec.Network{{Name: "qrystal0", Devices: []spec.NetworkDevice{device("a")}}}}, map[util.TokenHash]TokenInfo{})
+	store := new(failingStore)
+	err := s.SetStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.err = errors.New("injected")
+	revision := s.revisions["qrystal0"]["a"]
+	newSpec := s.spec.Clone()
+	newSpec.Networks[0].Devices = append(newSpec.Networks[0].Devices, device("c"))
+	err = s.updateSpec(newSpec)
+	if !errors.Is(err, store.err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := s.spec.Networks[0].GetDevice("c"); ok || s.revisions["qrystal0"]["a"] != revision {
+		t.Fatal("change applied without being saved")
+	}
+}
@@ -0,0 +1,265 @@
+package coord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nyiyui/qrystal/util"
+	"go.uber.org/zap"
+)
+
+// Scope is a set of actions a token is allowed to do.
+type Scope string
+
+const (
+	// ScopeReifyRead allows getting the spec and reporting its application status, for the token's Identities.
+	ScopeReifyRead Scope = "reify:read"
+	// ScopeReifyPatch allows patching the spec (e.g. setting the public key), for the token's Identities.
+	ScopeReifyPatch Scope = "reify:patch"
+	// ScopeAdmin allows using the admin API (/v1/admin/...).
+	ScopeAdmin Scope = "admin"
+)
+
+// defaultScopes are the scopes of a token without any scopes specified.
+var defaultScopes = []Scope{ScopeReifyRead, ScopeReifyPatch}
+
+type TokenInfo struct {
+	Identities [][2]string
+	// Scopes is the list of scopes this token has.
+	// Leave empty for ScopeReifyRead and ScopeReifyPatch.
+	// Must be empty for enrollment tokens (see Enroll).
+	Scopes []Scope
+	// NotBefore is the time from which the token is valid.
+	// Leave zero for no restriction.
+	NotBefore time.Time
+	// NotAfter is the time until which the token is valid.
+	// Leave zero for no restriction.
+	NotAfter time.Time
+	// Enroll makes this token an enrollment token (see EnrollInfo).
+	// Leave nil for a normal token.
+	Enroll *EnrollInfo
+}
+
+// Validate checks that the TokenInfo is well-formed.
+func (ti TokenInfo) Validate() error {
+	for _, scope := range ti.Scopes {
+		switch scope {
+		case ScopeReifyRead, ScopeReifyPatch, ScopeAdmin:
+		default:
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if !ti.NotBefore.IsZero() && !ti.NotAfter.IsZero() && ti.NotAfter.Before(ti.NotBefore) {
+		return errors.New("NotAfter is before NotBefore")
+	}
+	if ti.Enroll != nil {
+		if len(ti.Scopes) != 0 {
+			// enrollment tokens can only enroll; the issued token's scopes are in Enroll.Scopes
+			return errors.New("Scopes must be empty for enrollment tokens")
+		}
+		err := ti.Enroll.Validate()
+		if err != nil {
+			return fmt.Errorf("Enroll: %w", err)
+		}
+	}
+	return nil
+}
+
+// HasScope returns whether the token has the given scope.
+func (ti TokenInfo) HasScope(scope Scope) bool {
+	if len(ti.Scopes) == 0 {
+		return slices.Contains(defaultScopes, scope)
+	}
+	return slices.Contains(ti.Scopes, scope)
+}
+
+// ValidAt returns whether the token is valid at the given time.
+func (ti TokenInfo) ValidAt(t time.Time) bool {
+	if !ti.NotBefore.IsZero() && t.Before(ti.NotBefore) {
+		return false
+	}
+	if !ti.NotAfter.IsZero() && t.After(ti.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// authenticate returns the hash and TokenInfo for the token in the given request.
+// Revoked tokens and tokens outside of their validity period are rejected.
+// If this returns false, an error has been written to w, and the request should be aborted.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (tokenHash util.TokenHash, tokenInfo TokenInfo, ok bool) {
+	const prefix = "QrystalCoordIdentityToken "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		http.Error(w, "Authorization header must have type QrystalCoordIdentityToken", 401)
+		return util.TokenHash{}, TokenInfo{}, false
+	}
+	token, err := util.ParseToken(strings.TrimPrefix(header, prefix))
+	if err != nil {
+		http.Error(w, "bad token", 401)
+		return util.TokenHash{}, TokenInfo{}, false
+	}
+	tokenHash = *token.Hash()
+	s.tokensLock.RLock()
+	defer s.tokensLock.RUnlock()
+	tokenInfo, ok = s.tokens[tokenHash]
+	if !ok {
+		tokenInfo, ok = s.issued[tokenHash]
+	}
+	if !ok {
+		http.Error(w, "not authorized", 401)
+		return util.TokenHash{}, TokenInfo{}, false
+	}
+	if _, revoked := s.revoked[tokenHash]; revoked {
+		http.Error(w, "token revoked", 401)
+		return util.TokenHash{}, TokenInfo{}, false
+	}
+	if !tokenInfo.ValidAt(time.Now()) {
+		http.Error(w, "token expired or not yet valid", 401)
+		return util.TokenHash{}, TokenInfo{}, false
+	}
+	return tokenHash, tokenInfo, true
+}
+
+// verifyIdentity verifies if the given request has the credentials to identify as the given network device, with the given scope.
+// If this returns true, continue with the request.
+// If this returns false, abort the request.
+func (s *Server) verifyIdentity(w http.ResponseWriter, r *http.Request, network, device string, scope Scope) (ok bool) {
+	_, tokenInfo, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	if !slices.Contains(tokenInfo.Identities, [2]string{network, device}) {
+		http.Error(w, "not authorized", 401)
+		return false
+	}
+	if !tokenInfo.HasScope(scope) {
+		http.Error(w, fmt.Sprintf("token does not have scope %s", scope), 403)
+		return false
+	}
+	return true
+}
+
+// verifyAdmin verifies if the given request has the credentials to use the admin API.
+// If this returns true, continue with the request.
+// If this returns false, abort the request.
+func (s *Server) verifyAdmin(w http.ResponseWriter, r *http.Request) (ok bool) {
+	_, tokenInfo, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	if !tokenInfo.HasScope(ScopeAdmin) {
+		http.Error(w, fmt.Sprintf("token does not have scope %s", ScopeAdmin), 403)
+		return false
+	}
+	return true
+}
+
+// revokedListNoLock returns the revoked token hashes, sorted.
+// revokedListNoLock does not take any locks.
+func (s *Server) revokedListNoLock() []string {
+	revoked := make([]string, 0, len(s.revoked))
+	for tokenHash := range s.revoked {
+		revoked = append(revoked, tokenHash.String())
+	}
+	slices.Sort(revoked)
+	return revoked
+}
+
+// setRevoked revokes (or un-revokes) the given token, and saves the revocation list to Server.store, if any.
+// If saving fails, the token is still revoked (or un-revoked) until restart, and the error is returned.
+func (s *Server) setRevoked(tokenHash util.TokenHash, revoked bool) error {
+	// specLock serializes saves
+	s.specLock.Lock()
+	defer s.specLock.Unlock()
+	s.tokensLock.Lock()
+	if revoked {
+		s.revoked[tokenHash] = struct{}{}
+	} else {
+		delete(s.revoked, tokenHash)
+	}
+	s.tokensLock.Unlock()
+	err := s.saveNoLock()
+	if err != nil {
+		return fmt.Errorf("saving revoked tokens: %w", err)
+	}
+	return nil
+}
+
+type GetAdminRevokedResponse struct {
+	// Revoked is the list of hashes of revoked tokens.
+	Revoked []string
+}
+
+func (s *Server) getAdminRevoked(w http.ResponseWriter, r *http.Request) {
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	s.tokensLock.RLock()
+	resp := GetAdminRevokedResponse{Revoked: s.revokedListNoLock()}
+	s.tokensLock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		zap.S().Errorf("json encode and HTTP write of GetAdminRevokedResponse failed: %s", err)
+	}
+}
+
+type PostAdminRevokedRequest struct {
+	// Hash is the hash of the token to revoke.
+	Hash string
+}
+
+func (s *Server) postAdminRevoked(w http.ResponseWriter, r *http.Request) {
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	var req PostAdminRevokedRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	tokenHash, err := util.ParseTokenHash(req.Hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing token hash: %s", err), 400)
+		return
+	}
+	err = s.setRevoked(*tokenHash, true)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("revoked token %s.", tokenHash)
+	w.WriteHeader(204)
+}
+
+func (s *Server) deleteAdminRevoked(w http.ResponseWriter, r *http.Request) {
+	if !s.verifyAdmin(w, r) {
+		return
+	}
+	tokenHash, err := util.ParseTokenHash(r.PathValue("hash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing token hash: %s", err), 400)
+		return
+	}
+	s.tokensLock.RLock()
+	tokenInfo, ok := s.tokens[*tokenHash]
+	s.tokensLock.RUnlock()
+	if ok && tokenInfo.Enroll != nil {
+		// it may have been used already, and must not be used again
+		http.Error(w, "enrollment tokens cannot be unrevoked; add a new one instead", 409)
+		return
+	}
+	err = s.setRevoked(*tokenHash, false)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	zap.S().Infof("unrevoked token %s.", tokenHash)
+	w.WriteHeader(204)
+}
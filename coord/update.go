@@ -2,6 +2,7 @@ package coord
 
 import (
 	"cmp"
+	"fmt"
 	"slices"
 
 	"github.com/nyiyui/qrystal/spec"
@@ -9,21 +10,42 @@ import (
 
 // updateSpec replaces Server.spec with newSpec and updates Server.latest accordingly.
 // Server.specLock and Server.latestLock is taken by this function.
-func (s *Server) updateSpec(newSpec spec.Spec) {
+func (s *Server) updateSpec(newSpec spec.Spec) error {
 	s.specLock.Lock()
 	defer s.specLock.Unlock()
 	s.latestLock.Lock()
 	defer s.latestLock.Unlock()
-	s.updateSpecNoLock(newSpec)
+	return s.updateSpecNoLock(newSpec)
 }
 
-// updateSpecNoLock replaces Server.spec and updates Server.latest accordingly.
-// updateSpecNoLock does not take any locks.
+// updateSpecNoLock replaces Server.spec and updates Server.latest and Server.revisions accordingly.
+// The new spec is saved to Server.store (if any) first; if saving fails, nothing is changed and the error is returned.
+// Requests waiting for a spec change (see Server.getReifyLatest) are woken up.
+// updateSpecNoLock only takes Server.tokensLock.
 // See Server.updateSpec for details.
-func (s *Server) updateSpecNoLock(newSpec spec.Spec) {
+func (s *Server) updateSpecNoLock(newSpec spec.Spec) error {
+	revisions := cloneRevisions(s.revisions)
+	updateRevisions(revisions, s.spec, newSpec)
+	return s.replaceSpecNoLock(newSpec, revisions)
+}
+
+// replaceSpecNoLock is like updateSpecNoLock, but sets Server.revisions to the given revisions instead of updating them.
+func (s *Server) replaceSpecNoLock(newSpec spec.Spec, revisions map[string]map[string]uint64) error {
+	err := s.saveStateNoLock(newSpec, revisions)
+	if err != nil {
+		return fmt.Errorf("saving spec: %w", err)
+	}
 	for _, oldSN := range s.spec.Networks {
-		if _, ok := newSpec.GetNetwork(oldSN.Name); !ok {
+		newSN, ok := newSpec.GetNetwork(oldSN.Name)
+		if !ok {
 			delete(s.latest, oldSN.Name)
+			delete(s.peers, oldSN.Name)
+			continue
+		}
+		for device := range s.peers[oldSN.Name] {
+			if _, ok := newSN.GetDevice(device); !ok {
+				delete(s.peers[oldSN.Name], device)
+			}
 		}
 	}
 	for _, newSN := range newSpec.Networks {
@@ -46,7 +68,11 @@ func (s *Server) updateSpecNoLock(newSpec spec.Spec) {
 		}
 		s.latest[newSN.Name] = sliceUnion(keep, s.latest[newSN.Name])
 	}
+	s.revisions = revisions
 	s.spec = newSpec
+	close(s.specChanged)
+	s.specChanged = make(chan struct{})
+	return nil
 }
 
 // sliceUnion returns the union of the two given slices.
@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"maps"
+	"net"
 	"net/http"
 	"net/url"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/nyiyui/qrystal/coord"
 	"github.com/nyiyui/qrystal/dns"
@@ -21,48 +23,128 @@ import (
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// Client reconciles one or more networks into a single goal.Machine.
 type Client struct {
-	client     *http.Client
-	baseURL    *url.URL
 	applier    *goal.Applier
 	dns        dns.Client
 	dnsLock    sync.Mutex
 	canForward bool
+	// scorer scores the endpoints of peers. If nil, spec.PingCommandScorer is used.
+	scorer spec.EndpointScorer
+	// forwarderPolicy is how forwarders are chosen for peers without a working endpoint.
+	forwarderPolicy spec.ForwarderPolicy
 
-	spec       spec.SpecCensored
+	networks []*networkClient
+	// applyLock is held while compiling and applying the machine for all networks.
+	applyLock sync.Mutex
+	// machine is the machine last applied successfully, or nil if none has been applied yet.
+	// This is protected by applyLock.
+	machine *goal.Machine
+	// tornDown is whether Teardown was called, after which nothing is applied anymore.
+	// This is protected by applyLock.
+	tornDown bool
+}
+
+// networkClient is the state of a network (and the device in it) that a Client reconciles.
+type networkClient struct {
+	client     *http.Client
+	baseURL    *url.URL
 	token      util.Token
 	network    string
 	device     string
 	privateKey goal.Key
+	// nc is the spec last received from the coordination server (with endpoints chosen), or nil if none has been received yet.
+	// This is protected by Client.applyLock.
+	nc *spec.NetworkCensored
+	// revision is the revision of nc.
+	// This is 0 if the coordination server does not support revisions.
+	// This is protected by Client.applyLock.
+	revision uint64
+	// peerStatuses is the status of each peer at the last failover check (see Client.Failover).
+	// This is protected by Client.applyLock.
+	peerStatuses map[goal.Key]goal.PeerStatus
+	// failedEndpoints is when each endpoint (by address) was found to not work (see Client.Failover).
+	// This is protected by choicesLock.
+	failedEndpoints map[string]time.Time
+	// failedForwarders is when each forwarder (by device name) was found to not work (see Client.Failover).
+	// This is protected by choicesLock.
+	failedForwarders map[string]time.Time
+	// forwarders is the forwarder (by device name) last chosen for each device, so the same forwarder is chosen on the next reconcile.
+	// This is protected by choicesLock.
+	forwarders  map[string]string
+	choicesLock sync.Mutex
 }
 
+// NewClient creates a Client for a single network.
+// Use Client.AddNetwork to add more networks.
 func NewClient(httpClient *http.Client, baseURL string, token util.Token, network, device string, privateKey goal.Key) (*Client, error) {
-	baseURL2, err := url.Parse(baseURL)
+	applier, err := goal.NewApplier(goal.ApplierOptions{})
 	if err != nil {
 		return nil, err
 	}
-	applier, err := goal.NewApplier(goal.ApplierOptions{})
+	c := &Client{applier: applier}
+	err = c.AddNetwork(httpClient, baseURL, token, network, device, privateKey)
 	if err != nil {
 		return nil, err
 	}
+	return c, nil
+}
+
+// AddNetwork adds a network to reconcile.
+// Each network must have a different name, as the network name is used as the interface name.
+func (c *Client) AddNetwork(httpClient *http.Client, baseURL string, token util.Token, network, device string, privateKey goal.Key) error {
+	baseURL2, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
 	if httpClient == nil {
 		httpClient = new(http.Client)
 	}
-	return &Client{
+	if _, ok := c.getNetwork(network); ok {
+		return fmt.Errorf("network %s already added", network)
+	}
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+	c.networks = append(c.networks, &networkClient{
 		client:     httpClient,
 		baseURL:    baseURL2,
-		applier:    applier,
 		token:      token,
 		network:    network,
 		device:     device,
 		privateKey: privateKey,
-	}, nil
+	})
+	return nil
+}
+
+// Networks returns the names of the networks added to this client.
+func (c *Client) Networks() []string {
+	names := make([]string, len(c.networks))
+	for i, n := range c.networks {
+		names[i] = n.network
+	}
+	return names
+}
+
+func (c *Client) getNetwork(network string) (*networkClient, bool) {
+	i := slices.IndexFunc(c.networks, func(n *networkClient) bool { return n.network == network })
+	if i == -1 {
+		return nil, false
+	}
+	return c.networks[i], true
 }
 
 func (c *Client) SetCanForward(canForward bool) {
 	c.canForward = canForward
 }
 
+// SetApplier replaces the applier used to apply the machine (e.g. to use a goal.FakeBackend).
+func (c *Client) SetApplier(applier *goal.Applier) {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+	c.applier = applier
+}
+
+// SetAssumeProc replaces the applier with one using the system's backend.
 func (c *Client) SetAssumeProc(assumeProc bool) error {
 	var err error
 	c.applier, err = goal.NewApplier(goal.ApplierOptions{Linux: goal.ApplierOptionsLinux{ReadWriteProc: !assumeProc}})
@@ -72,18 +154,49 @@ func (c *Client) SetAssumeProc(assumeProc bool) error {
 	return nil
 }
 
+// SetEndpointScorer sets the scorer used to choose the endpoints of peers.
+func (c *Client) SetEndpointScorer(scorer spec.EndpointScorer) {
+	c.scorer = scorer
+}
+
+// SetForwarderPolicy sets how forwarders are chosen for peers without a working endpoint.
+func (c *Client) SetForwarderPolicy(policy spec.ForwarderPolicy) {
+	c.forwarderPolicy = policy
+}
+
+// choiceOptions is how endpoints and forwarders are chosen.
+type choiceOptions struct {
+	scorer          spec.EndpointScorer
+	forwarderPolicy spec.ForwarderPolicy
+	// localAddrs are the addresses of this machine (see Client.localAddresses).
+	localAddrs []net.IP
+}
+
+func (c *Client) choiceOptions() (choiceOptions, error) {
+	opts := choiceOptions{scorer: c.scorer, forwarderPolicy: c.forwarderPolicy}
+	if opts.scorer == nil {
+		opts.scorer = spec.PingCommandScorer
+	}
+	var err error
+	opts.localAddrs, err = c.localAddresses()
+	if err != nil {
+		return choiceOptions{}, fmt.Errorf("get local addresses: %w", err)
+	}
+	return opts, nil
+}
+
 func (c *Client) SetDNSClient(client dns.Client) {
 	c.dnsLock.Lock()
 	defer c.dnsLock.Unlock()
 	c.dns = client
 }
 
-func (c *Client) updateDNS() error {
+func (c *Client) updateDNS(sc spec.SpecCensored) error {
 	c.dnsLock.Lock()
 	defer c.dnsLock.Unlock()
 	if c.dns != nil {
 		zap.S().Debug("updating DNS server…")
-		err := c.dns.UpdateSpec(c.spec)
+		err := c.dns.UpdateSpec(sc)
 		if err != nil {
 			return fmt.Errorf("update DNS server: %w", err)
 		}
@@ -92,32 +205,101 @@ func (c *Client) updateDNS() error {
 	return nil
 }
 
-func (c *Client) addAuthorizationHeader(r *http.Request) {
-	r.Header.Set("Authorization", "QrystalCoordIdentityToken "+c.token.String())
+func (n *networkClient) addAuthorizationHeader(r *http.Request) {
+	r.Header.Set("Authorization", "QrystalCoordIdentityToken "+n.token.String())
 }
 
+// ReifySpec gets the spec of all networks, applies them, and posts the status of each network.
+// latest is true if all networks are up-to-date.
 func (c *Client) ReifySpec() (latest bool, err error) {
-	nc, err := c.getSpec()
+	ncs := make([]spec.NetworkCensored, len(c.networks))
+	revisions := make([]uint64, len(c.networks))
+	for i, n := range c.networks {
+		ncs[i], revisions[i], err = c.prepareNetwork(n)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", n.network, err)
+		}
+	}
+	c.applyLock.Lock()
+	for i, n := range c.networks {
+		n.nc = &ncs[i]
+		n.revision = revisions[i]
+	}
+	err = c.applyNoLock()
+	c.applyLock.Unlock()
 	if err != nil {
-		return false, fmt.Errorf("get spec: %w", err)
+		return false, err
+	}
+	latest = true
+	for i, n := range c.networks {
+		zap.S().Debugf("%s: posting status…", n.network)
+		networkLatest, err := n.postReifyStatus(ncs[i], revisions[i])
+		if err != nil {
+			return false, fmt.Errorf("%s: post status: %w", n.network, err)
+		}
+		latest = latest && networkLatest
 	}
+	zap.S().Debug("posted status.")
+	return latest, nil
+}
 
-	err = c.updateMyKeys(&nc)
+// ReifyNetwork gets the spec of the given network, applies it along with the specs of the other networks received so far, and posts the status of the given network.
+func (c *Client) ReifyNetwork(network string) (latest bool, err error) {
+	n, ok := c.getNetwork(network)
+	if !ok {
+		return false, fmt.Errorf("network %s not added", network)
+	}
+	nc, revision, err := c.prepareNetwork(n)
 	if err != nil {
 		return false, err
 	}
-
-	err = c.chooseEndpoints(&nc)
+	c.applyLock.Lock()
+	n.nc = &nc
+	n.revision = revision
+	err = c.applyNoLock()
+	c.applyLock.Unlock()
 	if err != nil {
 		return false, err
 	}
 
-	err = c.patchAccessible(&nc)
+	// === post status ===
+	zap.S().Debugf("%s: posting status…", n.network)
+	latest, err = n.postReifyStatus(nc, revision)
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("post status: %w", err)
+	}
+	zap.S().Debugf("%s: posted status.", n.network)
+	return latest, nil
+}
+
+// prepareNetwork gets the spec of the network, and updates the spec and the coordination server's copy to reflect this device (e.g. keys and chosen endpoints).
+// It returns the updated spec and its revision.
+func (c *Client) prepareNetwork(n *networkClient) (spec.NetworkCensored, uint64, error) {
+	nc, revision, err := n.getSpec()
+	if err != nil {
+		return spec.NetworkCensored{}, 0, fmt.Errorf("get spec: %w", err)
 	}
 
-	ndcI, ok := nc.GetDeviceIndex(c.device)
+	err = n.updateMyKeys(&nc, &revision)
+	if err != nil {
+		return spec.NetworkCensored{}, 0, err
+	}
+
+	opts, err := c.choiceOptions()
+	if err != nil {
+		return spec.NetworkCensored{}, 0, err
+	}
+	err = n.chooseEndpoints(&nc, opts)
+	if err != nil {
+		return spec.NetworkCensored{}, 0, err
+	}
+
+	err = n.patchAccessible(&nc, &revision, c.canForward)
+	if err != nil {
+		return spec.NetworkCensored{}, 0, err
+	}
+
+	ndcI, ok := nc.GetDeviceIndex(n.device)
 	if !ok {
 		panic("unreachable")
 	}
@@ -128,106 +310,271 @@ func (c *Client) ReifySpec() (latest bool, err error) {
 	zap.S().Debugf("ndc:\n%s", data)
 	data, _ = json.MarshalIndent(nc, "", "  ")
 	zap.S().Debugf("nc:\n%s", data)
-	c.spec = spec.SpecCensored{Networks: []spec.NetworkCensored{nc}}
+	return nc, revision, nil
+}
 
-	err = c.updateDNS()
+// applyNoLock compiles the specs of all networks received so far into one machine, and applies it.
+// Client.applyLock must be held.
+func (c *Client) applyNoLock() error {
+	if c.tornDown {
+		return errors.New("client torn down")
+	}
+	ncs := make([]*spec.NetworkCensored, len(c.networks))
+	for i, n := range c.networks {
+		ncs[i] = n.nc
+	}
+	sc, gm, err := c.compile(ncs)
 	if err != nil {
-		return false, fmt.Errorf("update DNS server: %w", err)
+		return err
 	}
 
-	zap.S().Debug("compiling spec…")
-	gm, err := c.spec.CompileMachine(c.device, true)
+	err = c.updateDNS(sc)
 	if err != nil {
-		return false, fmt.Errorf("compile spec: %w", err)
+		return fmt.Errorf("update DNS server: %w", err)
 	}
-	gm.Interfaces[0].PrivateKey = goal.Key(c.privateKey)
-	data, _ = json.Marshal(gm)
-	zap.S().Debugf("compiled spec:\n%s", data)
+
 	zap.S().Debug("applying machine…")
 	err = c.applier.ApplyMachine(gm)
 	if err != nil {
-		return false, fmt.Errorf("apply spec: %w", err)
+		return fmt.Errorf("apply spec: %w", err)
 	}
+	c.machine = &gm
 	zap.S().Debug("applied machine.")
+	return nil
+}
 
-	// === post status ===
-	zap.S().Debug("posting status…")
-	latest, err = c.postReifyStatus(nc)
+// Teardown removes all interfaces managed by the applier (see goal.Applier.Teardown), and the networks' names from the DNS server.
+// Nothing is applied by the Client afterwards.
+func (c *Client) Teardown() error {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+	c.tornDown = true
+	err := c.applier.Teardown()
 	if err != nil {
-		return false, fmt.Errorf("post status: %w", err)
+		return err
+	}
+	c.machine = nil
+	return c.updateDNS(spec.SpecCensored{})
+}
+
+// Heal compares the observed state of the managed interfaces with the machine last applied, and reapplies the machine if they differ.
+// The differences found are returned (even if reapplying fails).
+func (c *Client) Heal() ([]goal.Drift, error) {
+	c.applyLock.Lock()
+	defer c.applyLock.Unlock()
+	if c.machine == nil {
+		return nil, nil
+	}
+	drifts, err := c.applier.Drift(*c.machine)
+	if err != nil {
+		return nil, fmt.Errorf("check drift: %w", err)
+	}
+	if len(drifts) == 0 {
+		return nil, nil
+	}
+	err = c.applier.ApplyMachine(*c.machine)
+	if err != nil {
+		return drifts, fmt.Errorf("reapply: %w", err)
+	}
+	return drifts, nil
+}
+
+// compile compiles the specs of the networks (ncs[i] is the spec of c.networks[i], or nil if not received yet) into one machine.
+func (c *Client) compile(ncs []*spec.NetworkCensored) (spec.SpecCensored, goal.Machine, error) {
+	var sc spec.SpecCensored
+	var gm goal.Machine
+	zap.S().Debug("compiling spec…")
+	for i, n := range c.networks {
+		if ncs[i] == nil {
+			zap.S().Debugf("%s: spec not received yet, skip.", n.network)
+			// keep the interface (e.g. applied before a restart) until the spec is received
+			gm.KeepInterfaces = append(gm.KeepInterfaces, n.network)
+			continue
+		}
+		sc.Networks = append(sc.Networks, *ncs[i])
+		// device names can differ per network, so compile each network separately
+		ngm, err := spec.SpecCensored{Networks: []spec.NetworkCensored{*ncs[i]}}.CompileMachine(n.device, true)
+		if err != nil {
+			return spec.SpecCensored{}, goal.Machine{}, fmt.Errorf("compile spec: %s: %w", n.network, err)
+		}
+		for i := range ngm.Interfaces {
+			ngm.Interfaces[i].PrivateKey = n.privateKey
+		}
+		gm.Interfaces = append(gm.Interfaces, ngm.Interfaces...)
+		gm.ForwardsIPv4 = gm.ForwardsIPv4 || ngm.ForwardsIPv4
+		gm.ForwardsIPv6 = gm.ForwardsIPv6 || ngm.ForwardsIPv6
+	}
+	data, _ := json.Marshal(gm)
+	zap.S().Debugf("compiled spec:\n%s", data)
+	return sc, gm, nil
+}
+
+// PlanSpec gets the specs of all networks, and returns the changes ReifySpec would make to the system, without making them.
+// Unlike ReifySpec, PlanSpec does not generate private keys or change anything on the coordination server (e.g. public keys or accessible devices).
+// Endpoints and forwarders are chosen like ReifySpec does, but the choices are not kept for later reconciles.
+func (c *Client) PlanSpec() (goal.Plan, error) {
+	opts, err := c.choiceOptions()
+	if err != nil {
+		return goal.Plan{}, err
+	}
+	ncs := make([]*spec.NetworkCensored, len(c.networks))
+	for i, n := range c.networks {
+		n := n.choicesCopy()
+		nc, _, err := n.getSpec()
+		if err != nil {
+			return goal.Plan{}, fmt.Errorf("%s: get spec: %w", n.network, err)
+		}
+		err = n.chooseEndpoints(&nc, opts)
+		if err != nil {
+			return goal.Plan{}, fmt.Errorf("%s: %w", n.network, err)
+		}
+		ncs[i] = &nc
+	}
+	_, gm, err := c.compile(ncs)
+	if err != nil {
+		return goal.Plan{}, err
+	}
+	return c.applier.Plan(gm)
+}
+
+// PathTo gets the spec of the network, and returns the names of the devices packets from this device to the named device would pass through (see spec.NetworkCensored.PathTo).
+// Like PlanSpec, PathTo does not change anything on the system or the coordination server, and does not keep the endpoints and forwarders chosen.
+func (c *Client) PathTo(network, device string) ([]string, error) {
+	n, ok := c.getNetwork(network)
+	if !ok {
+		return nil, fmt.Errorf("network %s not added", network)
+	}
+	n = n.choicesCopy()
+	opts, err := c.choiceOptions()
+	if err != nil {
+		return nil, err
+	}
+	nc, _, err := n.getSpec()
+	if err != nil {
+		return nil, fmt.Errorf("%s: get spec: %w", n.network, err)
+	}
+	err = n.chooseEndpoints(&nc, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.network, err)
+	}
+	return nc.PathTo(device)
+}
+
+// choicesCopy returns a copy of n with its own copy of the endpoint and forwarder choices, so choosing with the copy does not affect n.
+func (n *networkClient) choicesCopy() *networkClient {
+	n.choicesLock.Lock()
+	defer n.choicesLock.Unlock()
+	return &networkClient{
+		client:           n.client,
+		baseURL:          n.baseURL,
+		token:            n.token,
+		network:          n.network,
+		device:           n.device,
+		privateKey:       n.privateKey,
+		failedEndpoints:  maps.Clone(n.failedEndpoints),
+		failedForwarders: maps.Clone(n.failedForwarders),
+		forwarders:       maps.Clone(n.forwarders),
 	}
-	zap.S().Debug("posted status.")
-	return latest, nil
 }
 
-func (c *Client) getSpec() (spec.NetworkCensored, error) {
-	path := c.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/spec", c.network, c.device)).String()
+// getSpec gets the spec of the network, and its revision (0 if the coordination server does not support revisions).
+func (n *networkClient) getSpec() (spec.NetworkCensored, uint64, error) {
+	path := n.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/spec", n.network, n.device)).String()
 	zap.S().Debugf("path: %s", path)
 	req, err := http.NewRequest("GET", path, nil)
 	if err != nil {
 		panic(err)
 	}
-	c.addAuthorizationHeader(req)
-	resp, err := c.client.Do(req)
+	n.addAuthorizationHeader(req)
+	resp, err := n.client.Do(req)
 	if err != nil {
-		return spec.NetworkCensored{}, fmt.Errorf("get spec: %w", err)
+		return spec.NetworkCensored{}, 0, fmt.Errorf("get spec: %w", err)
 	}
 	defer resp.Body.Close()
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return spec.NetworkCensored{}, fmt.Errorf("get spec: %w", err)
+		return spec.NetworkCensored{}, 0, fmt.Errorf("get spec: %w", err)
 	}
 	if resp.StatusCode != 200 && resp.StatusCode != 204 {
-		return spec.NetworkCensored{}, fmt.Errorf("get spec: %s: %s", resp.Status, data)
+		return spec.NetworkCensored{}, 0, fmt.Errorf("get spec: %s: %s", resp.Status, data)
 	}
+	revision, _ := coord.ParseRevisionETag(resp.Header.Get("ETag"))
+	zap.S().Debugf("received revision %d.", revision)
 	var nc spec.NetworkCensored
 	err = json.Unmarshal(data, &nc)
 	if err != nil {
 		zap.S().Debugf("received body:\n%s", data)
-		return spec.NetworkCensored{}, fmt.Errorf("get spec: %w", err)
+		return spec.NetworkCensored{}, 0, fmt.Errorf("get spec: %w", err)
 	}
 	data, _ = json.Marshal(nc)
 	zap.S().Debugf("received spec:\n%s", data)
-	zap.S().Debugf("c.device = %s", c.device)
-	return nc, nil
+	zap.S().Debugf("n.device = %s", n.device)
+	return nc, revision, nil
 }
 
-func (c *Client) updateMyKeys(nc *spec.NetworkCensored) error {
-	ndcI, ok := nc.GetDeviceIndex(c.device)
+// updateMyKeys generates a private key if needed, and patches the public key on the coordination server if it differs.
+// revision is the revision of nc, and is updated if the patch is reflected in nc.
+func (n *networkClient) updateMyKeys(nc *spec.NetworkCensored, revision *uint64) error {
+	ndcI, ok := nc.GetDeviceIndex(n.device)
 	if !ok {
 		panic("unreachable")
 	}
 	zap.S().Debugf("ndcI = %s", ndcI)
 	ndc := &nc.Devices[ndcI]
 	// === generate private keys ===
-	if c.privateKey == (goal.Key{}) {
+	if n.privateKey == (goal.Key{}) {
 		zap.S().Debug("generating private keys…")
 		privateKey, err := wgtypes.GeneratePrivateKey()
 		if err != nil {
 			panic(fmt.Sprintf("generate private key: %s", err))
 		}
-		c.privateKey = goal.Key(privateKey)
+		n.privateKey = goal.Key(privateKey)
 		zap.S().Debugf("generated key pair:\nprivate key: %s\npublic key: %s", privateKey, privateKey.PublicKey())
 	}
 	// === update spec's public keys ===
 	zap.S().Debugf("my public key is %s.", wgtypes.Key(ndc.PublicKey))
-	if wgtypes.Key(ndc.PublicKey) != wgtypes.Key(c.privateKey).PublicKey() {
+	if wgtypes.Key(ndc.PublicKey) != wgtypes.Key(n.privateKey).PublicKey() {
 		zap.S().Debug("public key set in spec mismatch, patching spec…")
-		err := c.patchSpec(coord.PatchReifySpecRequest{
-			PublicKey:    goal.Key(wgtypes.Key(c.privateKey).PublicKey()),
+		err := n.patchSpec(coord.PatchReifySpecRequest{
+			PublicKey:    goal.Key(wgtypes.Key(n.privateKey).PublicKey()),
 			PublicKeySet: true,
-		})
+		}, revision)
 		if err != nil {
 			return fmt.Errorf("patch spec: %w", err)
 		}
-		ndc.PublicKey = goal.Key(wgtypes.Key(c.privateKey).PublicKey())
+		ndc.PublicKey = goal.Key(wgtypes.Key(n.privateKey).PublicKey())
 		zap.S().Debug("patched spec public key.")
 	}
 	return nil
 }
 
-func (c *Client) chooseEndpoints(nc *spec.NetworkCensored) error {
-	ndcI, ok := nc.GetDeviceIndex(c.device)
+// localAddresses returns the addresses of this machine, except the addresses on the networks' interfaces (as endpoints are reached outside of them).
+func (c *Client) localAddresses() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	networks := c.Networks()
+	var localAddrs []net.IP
+	for _, iface := range ifaces {
+		if slices.Contains(networks, iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", iface.Name, err)
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				localAddrs = append(localAddrs, ipNet.IP)
+			}
+		}
+	}
+	return localAddrs, nil
+}
+
+func (n *networkClient) chooseEndpoints(nc *spec.NetworkCensored, opts choiceOptions) error {
+	ndcI, ok := nc.GetDeviceIndex(n.device)
 	if !ok {
 		panic("unreachable")
 	}
@@ -241,48 +588,102 @@ func (c *Client) chooseEndpoints(nc *spec.NetworkCensored) error {
 			continue
 		}
 		if !ndc.ForwarderAndEndpointChosen {
-			zap.S().Debugf("%s/%s: choosing endpoint…", c.network, ndc.Name)
-			err := (&nc.Devices[i]).ChooseEndpoint(spec.PingCommandScorer)
+			zap.S().Debugf("%s/%s: choosing endpoint…", n.network, ndc.Name)
+			err := (&nc.Devices[i]).ChooseEndpoint(n.excludeFailed(opts.scorer), opts.localAddrs)
 			if errors.Is(err, spec.ErrAllEndpointsBad) {
 				needsForwarders = append(needsForwarders, i)
-				zap.S().Debugf("%s/%s: needs forwarder.", c.network, ndc.Name)
+				zap.S().Debugf("%s/%s: needs forwarder.", n.network, ndc.Name)
 				continue
 			} else if err != nil {
-				return fmt.Errorf("choose endpoint for %s/%s: %w", c.network, ndc.Name, err)
+				return fmt.Errorf("choose endpoint for %s/%s: %w", n.network, ndc.Name, err)
 			}
 			if !nc.Devices[i].ForwarderAndEndpointChosen {
 				panic("unreachable")
 			}
-			zap.S().Debugf("%s/%s: endpoint %s chosen.", c.network, ndc.Name, ndc.Endpoints[ndc.EndpointChosenIndex])
+			zap.S().Debugf("%s/%s: endpoint %s chosen.", n.network, ndc.Name, ndc.Endpoints[ndc.EndpointChosenIndex])
+		}
+	}
+	// forwarders can be forwarded to as well, so keep choosing until no more forwarders can be chosen
+	for len(needsForwarders) > 0 {
+		remaining := make([]int, 0, len(needsForwarders))
+		for _, i := range needsForwarders {
+			ok, err := n.chooseForwarder(nc, i, opts)
+			if err != nil {
+				return fmt.Errorf("choose forwarder for %s/%s: %w", n.network, nc.Devices[i].Name, err)
+			}
+			if !ok {
+				remaining = append(remaining, i)
+			}
 		}
+		if len(remaining) == len(needsForwarders) {
+			break
+		}
+		needsForwarders = remaining
 	}
 	for _, i := range needsForwarders {
+		zap.S().Infof("%s/%s has no forwarder or reachable endpoint. I'll continue with no Endpoint, and hope they connect to me.", n.network, nc.Devices[i].Name)
+		nc.Devices[i].ForwarderAndEndpointChosen = false
+	}
+	return nil
+}
+
+// chooseForwarder chooses a forwarder for the i-th device, and returns false (without changing nc) if there is none.
+// The forwarder chosen last time is chosen again if it can still forward for the device, and has not failed (see Client.Failover).
+// Otherwise, a healthy forwarder is chosen using opts.forwarderPolicy.
+// Forwarders which would make a loop, or too many hops (see spec.NetworkCensored.PathTo), are never chosen.
+func (n *networkClient) chooseForwarder(nc *spec.NetworkCensored, i int, opts choiceOptions) (bool, error) {
+	name := nc.Devices[i].Name
+	zap.S().Debugf("%s/%s: choosing forwarder…", n.network, name)
+	var candidates []int
+	for _, j := range nc.GetForwardersFor(name) {
+		if nc.CanForwardVia(i, j) && n.forwarderHealthy(nc.Devices[j]) {
+			candidates = append(candidates, j)
+		}
+	}
+	if len(candidates) == 0 {
+		return false, nil
+	}
+	n.choicesLock.Lock()
+	prev, ok := n.forwarders[name]
+	n.choicesLock.Unlock()
+	j := slices.IndexFunc(candidates, func(j int) bool { return ok && nc.Devices[j].Name == prev })
+	if j != -1 {
+		j = candidates[j]
+	} else {
+		// don't count the device itself towards its current forwarder's load
 		ndc := nc.Devices[i]
-		zap.S().Debugf("%s/%s: choosing forwarder…", c.network, ndc.Name)
-		forwarders := nc.GetForwardersFor(ndc.Name)
-		if len(forwarders) == 0 {
-			zap.S().Infof("%s/%s has no forwarder or reachable endpoint. I'll continue with no Endpoint, and hope they connect to me.", c.network, ndc.Name)
-			nc.Devices[i].ForwarderAndEndpointChosen = false
-			continue
+		nc.Devices[i].UsesForwarder = false
+		var err error
+		j, err = nc.ChooseForwarder(name, candidates, opts.forwarderPolicy, n.excludeFailed(opts.scorer))
+		nc.Devices[i] = ndc
+		if err != nil {
+			return false, err
 		}
-		j := rand.Intn(len(forwarders))
-		nc.Devices[i].ForwarderChosenIndex = forwarders[j]
-		nc.Devices[i].UsesForwarder = true
-		nc.Devices[i].ForwarderAndEndpointChosen = true
-		zap.S().Debugf("%s/%s: forwarder %s chosen.", c.network, ndc.Name, nc.Devices[forwarders[j]].Name)
 	}
-	return nil
+	nc.Devices[i].ForwarderChosenIndex = j
+	nc.Devices[i].UsesForwarder = true
+	nc.Devices[i].ForwarderAndEndpointChosen = true
+	n.choicesLock.Lock()
+	if n.forwarders == nil {
+		n.forwarders = map[string]string{}
+	}
+	n.forwarders[name] = nc.Devices[j].Name
+	n.choicesLock.Unlock()
+	zap.S().Debugf("%s/%s: forwarder %s chosen.", n.network, name, nc.Devices[j].Name)
+	return true, nil
 }
 
-func (c *Client) patchAccessible(nc *spec.NetworkCensored) error {
-	ndcI, ok := nc.GetDeviceIndex(c.device)
+// patchAccessible patches the devices this device can forward for on the coordination server, if they differ.
+// revision is the revision of nc, and is updated if the patch is reflected in nc.
+func (n *networkClient) patchAccessible(nc *spec.NetworkCensored, revision *uint64, canForward bool) error {
+	ndcI, ok := nc.GetDeviceIndex(n.device)
 	if !ok {
 		panic("unreachable")
 	}
 	zap.S().Debugf("ndcI = %s", ndcI)
 
 	var accessible []string
-	if c.canForward {
+	if canForward {
 		for _, ndc := range nc.Devices {
 			if ndc.ForwarderAndEndpointChosen {
 				accessible = append(accessible, ndc.Name)
@@ -294,10 +695,10 @@ func (c *Client) patchAccessible(nc *spec.NetworkCensored) error {
 	}
 	if !slices.Equal(accessible, nc.Devices[ndcI].Accessible) {
 		nc.Devices[ndcI].Accessible = accessible
-		err := c.patchSpec(coord.PatchReifySpecRequest{
+		err := n.patchSpec(coord.PatchReifySpecRequest{
 			Accessible:    accessible,
 			AccessibleSet: true,
-		})
+		}, revision)
 		if err != nil {
 			return fmt.Errorf("patch spec: %w", err)
 		}
@@ -305,18 +706,21 @@ func (c *Client) patchAccessible(nc *spec.NetworkCensored) error {
 	return nil
 }
 
-func (c *Client) patchSpec(body coord.PatchReifySpecRequest) error {
+// patchSpec patches this device on the coordination server.
+// revision is the revision of the caller's copy of the spec (which the patch is applied to), and is updated to the revision after the patch if nothing else changed the network in between.
+func (n *networkClient) patchSpec(body coord.PatchReifySpecRequest, revision *uint64) error {
 	data, err := json.Marshal(body)
 	if err != nil {
 		panic(err)
 	}
-	req, err := http.NewRequest("PATCH", c.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/spec", c.network, c.device)).String(), bytes.NewBuffer(data))
+	req, err := http.NewRequest("PATCH", n.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/spec", n.network, n.device)).String(), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	c.addAuthorizationHeader(req)
-	resp, err := c.client.Do(req)
+	// no If-Match, as only fields owned by this device are patched, and any change to this device's view (e.g. other devices' patches) would fail the patch
+	n.addAuthorizationHeader(req)
+	resp, err := n.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("post status: %w", err)
 	}
@@ -325,23 +729,34 @@ func (c *Client) patchSpec(body coord.PatchReifySpecRequest) error {
 		data, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("%s: %s", resp.Status, data)
 	}
+	if *revision != 0 {
+		// the patch is reflected in the caller's copy of the spec, so the caller's copy is at the new revision if the patch was the only change
+		// otherwise, the old revision is kept, so the coordination server reports the copy as outdated and it is received again
+		newRevision, _ := coord.ParseRevisionETag(resp.Header.Get("ETag"))
+		if newRevision == *revision+1 {
+			*revision = newRevision
+		}
+	}
 	return nil
 }
 
-func (c *Client) postReifyStatus(nc spec.NetworkCensored) (latest bool, err error) {
-	data, err := json.Marshal(coord.PostReifyStatusRequest{
-		Reified: nc,
-	})
+// postReifyStatus reports nc (at the given revision) as applied to the coordination server.
+func (n *networkClient) postReifyStatus(nc spec.NetworkCensored, revision uint64) (latest bool, err error) {
+	body := coord.PostReifyStatusRequest{Revision: revision, Peers: n.peerChoices(nc)}
+	if revision == 0 {
+		body.Reified = &nc
+	}
+	data, err := json.Marshal(body)
 	if err != nil {
 		panic(fmt.Sprintf("json marshal: %s", err))
 	}
-	req, err := http.NewRequest("POST", c.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/status", c.network, c.device)).String(), bytes.NewBuffer(data))
+	req, err := http.NewRequest("POST", n.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/status", n.network, n.device)).String(), bytes.NewBuffer(data))
 	if err != nil {
 		panic(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	c.addAuthorizationHeader(req)
-	resp, err := c.client.Do(req)
+	n.addAuthorizationHeader(req)
+	resp, err := n.client.Do(req)
 	if err != nil {
 		return false, fmt.Errorf("post status: %w", err)
 	}
@@ -0,0 +1,511 @@
+package device
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nyiyui/qrystal/coord"
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
+	"github.com/nyiyui/qrystal/util"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustIPNet(t *testing.T, s string) goal.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goal.IPNet(*ipNet)
+}
+
+func mustToken(t *testing.T) *util.Token {
+	token, err := util.RandomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestReifySpec(t *testing.T) {
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := func(name, device string, self, peer string) spec.Network {
+		return spec.Network{
+			Name: name,
+			Devices: []spec.NetworkDevice{
+				{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: device, Addresses: []goal.IPNet{mustIPNet(t, self)}}, AccessControl: spec.AccessControl{AccessAll: true}},
+				{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "peer", Addresses: []goal.IPNet{mustIPNet(t, peer)}, PublicKey: goal.Key(peerKey.PublicKey())}, AccessControl: spec.AccessControl{AccessAll: true}},
+			},
+		}
+	}
+	token0 := mustToken(t)
+	token1 := mustToken(t)
+	cs := coord.NewServer(spec.Spec{Networks: []spec.Network{
+		network("qrystal0", "a", "10.10.0.1/32", "10.10.0.2/32"),
+		network("qrystal1", "x", "10.11.0.1/32", "10.11.0.2/32"),
+	}}, map[util.TokenHash]coord.TokenInfo{
+		*token0.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}},
+		*token1.Hash(): {Identities: [][2]string{{"qrystal1", "x"}}},
+	})
+	server := httptest.NewServer(cs)
+	defer server.Close()
+
+	c, err := NewClient(nil, server.URL, *token0, "qrystal0", "a", goal.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AddNetwork(nil, server.URL, *token1, "qrystal1", "x", goal.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := new(goal.FakeBackend)
+	applier, err := goal.NewApplier(goal.ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetApplier(applier)
+
+	latest, err := c.ReifySpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest {
+		t.Fatal("not latest after reifying")
+	}
+	for _, tc := range []struct{ name, address, peer string }{
+		{"qrystal0", "10.10.0.1/32", "10.10.0.2/32"},
+		{"qrystal1", "10.11.0.1/32", "10.11.0.2/32"},
+	} {
+		link, ok := backend.Link(tc.name)
+		if !ok {
+			t.Fatalf("%s: interface not created", tc.name)
+		}
+		if len(link.Addresses) != 1 || (*net.IPNet)(&link.Addresses[0]).String() != tc.address {
+			t.Fatalf("%s: unexpected addresses %v", tc.name, link.Addresses)
+		}
+		if len(link.Device.Peers) != 1 || link.Device.Peers[0].PublicKey != peerKey.PublicKey() {
+			t.Fatalf("%s: unexpected peers %#v", tc.name, link.Device.Peers)
+		}
+		if len(link.Routes) != 1 || (*net.IPNet)(&link.Routes[0]).String() != tc.peer {
+			t.Fatalf("%s: unexpected routes %v", tc.name, link.Routes)
+		}
+		if link.Device.PrivateKey == (wgtypes.Key{}) {
+			t.Fatalf("%s: private key not set", tc.name)
+		}
+	}
+}
+
+func TestRestartKeepsOtherNetworks(t *testing.T) {
+	network := func(name, device, self string) spec.Network {
+		return spec.Network{
+			Name: name,
+			Devices: []spec.NetworkDevice{
+				{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: device, Addresses: []goal.IPNet{mustIPNet(t, self)}}, AccessControl: spec.AccessControl{AccessAll: true}},
+			},
+		}
+	}
+	token0 := mustToken(t)
+	token1 := mustToken(t)
+	cs := coord.NewServer(spec.Spec{Networks: []spec.Network{
+		network("qrystal0", "a", "10.10.0.1/32"),
+		network("qrystal1", "x", "10.11.0.1/32"),
+	}}, map[util.TokenHash]coord.TokenInfo{
+		*token0.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}},
+		*token1.Hash(): {Identities: [][2]string{{"qrystal1", "x"}}},
+	})
+	server := httptest.NewServer(cs)
+	defer server.Close()
+
+	backend := new(goal.FakeBackend)
+	newClient := func() *Client {
+		c, err := NewClient(nil, server.URL, *token0, "qrystal0", "a", goal.Key{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.AddNetwork(nil, server.URL, *token1, "qrystal1", "x", goal.Key{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		applier, err := goal.NewApplier(goal.ApplierOptions{Backend: backend})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetApplier(applier)
+		return c
+	}
+
+	_, err := newClient().ReifySpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// restart, and receive the spec of one network only
+	c := newClient()
+	_, err = c.ReifyNetwork("qrystal0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Link("qrystal1"); !ok {
+		t.Fatal("interface of a network whose spec was not received yet deleted")
+	}
+	drifts, err := c.Heal()
+	if err != nil || len(drifts) != 0 {
+		t.Fatalf("expected no drift, got drifts %v and error %v", drifts, err)
+	}
+}
+
+func TestHeal(t *testing.T) {
+	token := mustToken(t)
+	cs := coord.NewServer(spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a", Addresses: []goal.IPNet{mustIPNet(t, "10.10.0.1/32")}}, AccessControl: spec.AccessControl{AccessAll: true}},
+		},
+	}}}, map[util.TokenHash]coord.TokenInfo{
+		*token.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}},
+	})
+	server := httptest.NewServer(cs)
+	defer server.Close()
+
+	c, err := NewClient(nil, server.URL, *token, "qrystal0", "a", goal.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := new(goal.FakeBackend)
+	applier, err := goal.NewApplier(goal.ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetApplier(applier)
+
+	drifts, err := c.Heal()
+	if err != nil || len(drifts) != 0 {
+		t.Fatalf("nothing applied yet, but got drifts %v and error %v", drifts, err)
+	}
+	_, err = c.ReifySpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	drifts, err = c.Heal()
+	if err != nil || len(drifts) != 0 {
+		t.Fatalf("expected no drift, got drifts %v and error %v", drifts, err)
+	}
+
+	err = backend.DeleteLink("qrystal0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drifts, err = c.Heal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 1 || drifts[0].Interface != "qrystal0" {
+		t.Fatalf("unexpected drifts %v", drifts)
+	}
+	link, ok := backend.Link("qrystal0")
+	if !ok || len(link.Addresses) != 1 {
+		t.Fatalf("interface not restored: %#v", link)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := mustToken(t)
+	admin := mustToken(t)
+	cs := coord.NewServer(spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a", Addresses: []goal.IPNet{mustIPNet(t, "10.10.0.1/32")}}, AccessControl: spec.AccessControl{AccessAll: true}},
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "b", Addresses: []goal.IPNet{mustIPNet(t, "10.10.0.2/32")}, PublicKey: goal.Key(peerKey.PublicKey()), Endpoints: spec.Endpoints("192.0.2.1:51820", "192.0.2.2:51820")}, AccessControl: spec.AccessControl{AccessAll: true}},
+		},
+	}}}, map[util.TokenHash]coord.TokenInfo{
+		*token.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}},
+		*admin.Hash(): {Scopes: []coord.Scope{coord.ScopeAdmin}},
+	})
+	server := httptest.NewServer(cs)
+	defer server.Close()
+
+	c, err := NewClient(nil, server.URL, *token, "qrystal0", "a", goal.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetEndpointScorer(func(string) (int, error) { return 0, nil })
+	backend := new(goal.FakeBackend)
+	applier, err := goal.NewApplier(goal.ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetApplier(applier)
+	_, err = c.ReifySpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := func() string {
+		link, _ := backend.Link("qrystal0")
+		if len(link.Device.Peers) != 1 {
+			t.Fatalf("unexpected peers: %v", link.Device.Peers)
+		}
+		return link.Device.Peers[0].Endpoint.String()
+	}
+	reportedEndpoint := func() string {
+		req := httptest.NewRequest("GET", server.URL+"/v1/admin/networks/qrystal0/devices/a/peers", nil)
+		req.RequestURI = ""
+		req.Header.Set("Authorization", "QrystalCoordIdentityToken "+admin.String())
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body coord.GetAdminDevicePeersResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Peers) != 1 || body.Peers[0].Peer != "b" {
+			t.Fatalf("unexpected peers reported: %v", body.Peers)
+		}
+		return body.Peers[0].Endpoint
+	}
+	if e := endpoint(); e != "192.0.2.1:51820" {
+		t.Fatalf("unexpected endpoint %s", e)
+	}
+	if e := reportedEndpoint(); e != "192.0.2.1:51820" {
+		t.Fatalf("unexpected endpoint reported %s", e)
+	}
+
+	// packets are sent to b, but nothing comes back
+	transmit := func() {
+		ok := backend.UpdatePeer("qrystal0", peerKey.PublicKey(), func(peer *wgtypes.Peer) {
+			peer.TransmitBytes += 148
+		})
+		if !ok {
+			t.Fatal("peer not found")
+		}
+	}
+	transmit()
+	failedOver, err := c.Failover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedOver) != 0 {
+		t.Fatalf("failed over without a previous check: %v", failedOver)
+	}
+	transmit()
+	failedOver, err = c.Failover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedOver) != 1 || failedOver[0] != "qrystal0/b" {
+		t.Fatalf("unexpected failovers %v", failedOver)
+	}
+	if e := endpoint(); e != "192.0.2.2:51820" {
+		t.Fatalf("did not fail over: endpoint %s", e)
+	}
+	if e := reportedEndpoint(); e != "192.0.2.2:51820" {
+		t.Fatalf("failover not reported: endpoint %s", e)
+	}
+
+	// the failed endpoint is not chosen again when reconciling
+	_, err = c.ReifySpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := endpoint(); e != "192.0.2.2:51820" {
+		t.Fatalf("failed endpoint chosen again: %s", e)
+	}
+
+	// nothing else to fail over to
+	transmit()
+	transmit()
+	failedOver, err = c.Failover()
+	if err != nil || len(failedOver) != 0 {
+		t.Fatalf("expected no failovers, got %v and error %v", failedOver, err)
+	}
+	if e := endpoint(); e != "192.0.2.2:51820" {
+		t.Fatalf("endpoint changed: %s", e)
+	}
+}
+
+func TestForwarderFailover(t *testing.T) {
+	keys := map[string]wgtypes.Key{}
+	for _, name := range []string{"b", "f1", "f2"} {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key.PublicKey()
+	}
+	token := mustToken(t)
+	device := func(name, address string, endpoints []spec.Endpoint, accessible []string) spec.NetworkDevice {
+		return spec.NetworkDevice{
+			NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: name, Addresses: []goal.IPNet{mustIPNet(t, address)}, PublicKey: goal.Key(keys[name]), Endpoints: endpoints, Accessible: accessible},
+			AccessControl:         spec.AccessControl{AccessAll: true},
+		}
+	}
+	cs := coord.NewServer(spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			device("a", "10.10.0.1/32", nil, nil),
+			device("b", "10.10.0.2/32", nil, nil),
+			device("f1", "10.10.0.3/32", spec.Endpoints("192.0.2.1:51820"), []string{"b"}),
+			device("f2", "10.10.0.4/32", spec.Endpoints("192.0.2.2:51820"), []string{"b"}),
+		},
+	}}}, map[util.TokenHash]coord.TokenInfo{
+		*token.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}},
+	})
+	server := httptest.NewServer(cs)
+	defer server.Close()
+
+	c, err := NewClient(nil, server.URL, *token, "qrystal0", "a", goal.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetEndpointScorer(func(string) (int, error) { return 0, nil })
+	backend := new(goal.FakeBackend)
+	applier, err := goal.NewApplier(goal.ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetApplier(applier)
+	// forwarder returns the name of the forwarder whose peer has b's address.
+	forwarder := func() string {
+		link, _ := backend.Link("qrystal0")
+		for _, peer := range link.Device.Peers {
+			for _, allowedIP := range peer.AllowedIPs {
+				if allowedIP.String() == "10.10.0.2/32" {
+					for name, key := range keys {
+						if key == peer.PublicKey {
+							return name
+						}
+					}
+				}
+			}
+		}
+		t.Fatalf("no peer forwards for b: %v", link.Device.Peers)
+		return ""
+	}
+
+	// dry runs do not keep their choices
+	_, err = c.PlanSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := c.PathTo("qrystal0", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(path) != 2 || path[1] != "b" {
+		t.Fatalf("unexpected path %v", path)
+	}
+	if n := c.networks[0]; len(n.forwarders) != 0 || n.revision != 0 {
+		t.Fatalf("dry run changed forwarders %v or revision %d", n.forwarders, n.revision)
+	}
+
+	_, err = c.ReifySpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := forwarder()
+	// the same forwarder is chosen on every reconcile
+	for range 3 {
+		_, err = c.ReifySpec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := forwarder(); f != first {
+			t.Fatalf("forwarder changed from %s to %s", first, f)
+		}
+	}
+
+	// the forwarder stops working, and has no other endpoint
+	transmit := func() {
+		ok := backend.UpdatePeer("qrystal0", keys[first], func(peer *wgtypes.Peer) {
+			peer.TransmitBytes += 148
+		})
+		if !ok {
+			t.Fatal("peer not found")
+		}
+	}
+	transmit()
+	_, err = c.Failover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transmit()
+	failedOver, err := c.Failover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failedOver) != 1 || failedOver[0] != "qrystal0/b" {
+		t.Fatalf("unexpected failovers %v", failedOver)
+	}
+	second := forwarder()
+	if second == first {
+		t.Fatalf("forwarder %s not replaced", first)
+	}
+	_, err = c.ReifySpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := forwarder(); f != second {
+		t.Fatalf("forwarder changed from %s to %s after failover", second, f)
+	}
+}
+
+func TestPatchSpecConcurrentChange(t *testing.T) {
+	tokenA := mustToken(t)
+	tokenB := mustToken(t)
+	cs := coord.NewServer(spec.Spec{Networks: []spec.Network{{
+		Name: "qrystal0",
+		Devices: []spec.NetworkDevice{
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "a", Addresses: []goal.IPNet{mustIPNet(t, "10.10.0.1/32")}}, AccessControl: spec.AccessControl{AccessAll: true}},
+			{NetworkDeviceCensored: spec.NetworkDeviceCensored{Name: "b", Addresses: []goal.IPNet{mustIPNet(t, "10.10.0.2/32")}}, AccessControl: spec.AccessControl{AccessAll: true}},
+		},
+	}}}, map[util.TokenHash]coord.TokenInfo{
+		*tokenA.Hash(): {Identities: [][2]string{{"qrystal0", "a"}}},
+		*tokenB.Hash(): {Identities: [][2]string{{"qrystal0", "b"}}},
+	})
+	server := httptest.NewServer(cs)
+	defer server.Close()
+	a, err := NewClient(nil, server.URL, *tokenA, "qrystal0", "a", goal.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewClient(nil, server.URL, *tokenB, "qrystal0", "b", goal.Key{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	na, nb := a.networks[0], b.networks[0]
+
+	_, revision, err := na.getSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, revisionB, err := nb.getSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b changes the network after a received the spec
+	err = nb.patchSpec(coord.PatchReifySpecRequest{Accessible: []string{"a"}, AccessibleSet: true}, &revisionB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revisionB != revision+1 {
+		t.Fatalf("only b's patch changed the network, but b's copy is at revision %d (expected %d)", revisionB, revision+1)
+	}
+	oldRevision := revision
+	err = na.patchSpec(coord.PatchReifySpecRequest{Accessible: []string{"b"}, AccessibleSet: true}, &revision)
+	if err != nil {
+		t.Fatalf("patch after another device's change: %s", err)
+	}
+	if revision != oldRevision {
+		t.Fatalf("a's copy (without b's change) marked as revision %d", revision)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/nyiyui/qrystal/coord"
 	"go.uber.org/zap"
@@ -12,7 +14,15 @@ import (
 
 type ContinousClient struct {
 	Client *Client
-	latest bool
+	// Network is the network to keep up-to-date.
+	// Leave blank if Client only has one network.
+	Network string
+	// LongPollWait is how long the coordination server is asked to wait for a spec change before responding.
+	// Set to 0 to poll without waiting.
+	// If the coordination server does not support waiting, ContinousClient falls back to polling.
+	LongPollWait time.Duration
+	latest       bool
+	noLongPoll   bool
 }
 
 func (c *ContinousClient) Step() (latest, updated bool, err error) {
@@ -21,7 +31,7 @@ func (c *ContinousClient) Step() (latest, updated bool, err error) {
 		f = c.getLatest
 		updated = false
 	} else {
-		f = c.Client.ReifySpec
+		f = func() (bool, error) { return c.Client.ReifyNetwork(c.networkClient().network) }
 		updated = true
 	}
 	var newLatest bool
@@ -34,13 +44,45 @@ func (c *ContinousClient) Step() (latest, updated bool, err error) {
 	return
 }
 
+// LongPolls returns whether Step waits for spec changes on the coordination server, so Step can be called again right away.
+func (c *ContinousClient) LongPolls() bool {
+	return c.LongPollWait != 0 && !c.noLongPoll
+}
+
+func (c *ContinousClient) networkClient() *networkClient {
+	if c.Network == "" {
+		if len(c.Client.networks) != 1 {
+			panic("ContinousClient.Network must be set if Client has multiple networks")
+		}
+		return c.Client.networks[0]
+	}
+	n, ok := c.Client.getNetwork(c.Network)
+	if !ok {
+		panic(fmt.Sprintf("ContinousClient.Network %s not added to Client", c.Network))
+	}
+	return n
+}
+
 func (c *ContinousClient) getLatest() (latest bool, err error) {
-	req, err := http.NewRequest("GET", c.Client.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/latest", c.Client.network, c.Client.device)).String(), nil)
+	n := c.networkClient()
+	u := n.baseURL.JoinPath(fmt.Sprintf("/v1/reify/%s/%s/latest", n.network, n.device))
+	httpClient := n.client
+	longPoll := c.LongPolls()
+	if longPoll {
+		u.RawQuery = url.Values{"wait": {c.LongPollWait.String()}}.Encode()
+		// the usual timeout would cut the request short
+		httpClient2 := *httpClient
+		if httpClient2.Timeout != 0 {
+			httpClient2.Timeout += c.LongPollWait
+		}
+		httpClient = &httpClient2
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
 		panic(err)
 	}
-	c.Client.addAuthorizationHeader(req)
-	resp, err := c.Client.client.Do(req)
+	n.addAuthorizationHeader(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return false, fmt.Errorf("get latest: %w", err)
 	}
@@ -52,6 +94,10 @@ func (c *ContinousClient) getLatest() (latest bool, err error) {
 	if resp.StatusCode != 200 {
 		return false, fmt.Errorf("get latest: %s: %s", resp.Status, data)
 	}
+	if longPoll && resp.Header.Get(coord.LatestWaitHeader) == "" {
+		zap.S().Info("coordination server does not support long-polling; falling back to polling.")
+		c.noLongPoll = true
+	}
 	var respData coord.GetReifyLatestResponse
 	err = json.Unmarshal(data, &respData)
 	if err != nil {
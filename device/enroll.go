@@ -0,0 +1,51 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/nyiyui/qrystal/coord"
+	"github.com/nyiyui/qrystal/util"
+)
+
+// Enroll creates the given device on the coordination server using an enrollment token.
+// The returned token identifies as the created device, and should be used with NewClient.
+func Enroll(httpClient *http.Client, baseURL string, enrollToken util.Token, network, device string) (*util.Token, error) {
+	baseURL2, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = new(http.Client)
+	}
+	req, err := http.NewRequest("POST", baseURL2.JoinPath(fmt.Sprintf("/v1/enroll/%s/%s", network, device)).String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", "QrystalCoordIdentityToken "+enrollToken.String())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("enroll: %w", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("enroll: %s: %s", resp.Status, data)
+	}
+	var respData coord.EnrollResponse
+	err = json.Unmarshal(data, &respData)
+	if err != nil {
+		return nil, fmt.Errorf("enroll: json decode: %w", err)
+	}
+	if respData.Token == nil || respData.Token.Empty() {
+		return nil, errors.New("enroll: no token returned")
+	}
+	return respData.Token, nil
+}
@@ -0,0 +1,280 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nyiyui/qrystal/coord"
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/spec"
+	"go.uber.org/zap"
+)
+
+// staleHandshakeAfter is how long after the last handshake a peer is considered unreachable (if packets are sent to it, but none are received).
+// WireGuard rejects sessions older than 3 minutes, so a reachable peer handshakes at least this often while packets are sent to it.
+const staleHandshakeAfter = 3 * time.Minute
+
+// failedEndpointExpiry is how long an endpoint (or forwarder) found to not work is not chosen again.
+const failedEndpointExpiry = 10 * time.Minute
+
+// Failover checks the handshakes of peers reached through an endpoint, and chooses another endpoint (or a forwarder) for peers that are unreachable.
+// If an unreachable peer is a forwarder and there is nothing else to choose for it, other forwarders are chosen for the devices it forwards for.
+// The machine is reapplied (which only changes the affected peers), and the new choices are reported to the coordination servers.
+// It returns the names (network/device) of the peers failed over.
+func (c *Client) Failover() ([]string, error) {
+	now := time.Now()
+	type staleNetwork struct {
+		n *networkClient
+		// nc is n.nc when the stale peers were found.
+		nc    *spec.NetworkCensored
+		stale []int
+		// newNC is nc with the peers failed over, or nil if none were.
+		newNC      *spec.NetworkCensored
+		failedOver []string
+	}
+
+	// === find stale peers ===
+	c.applyLock.Lock()
+	if c.machine == nil || c.tornDown {
+		c.applyLock.Unlock()
+		return nil, nil
+	}
+	var stales []staleNetwork
+	for _, n := range c.networks {
+		if n.nc == nil {
+			continue
+		}
+		statuses, err := c.applier.PeerStatuses(n.network)
+		if err != nil {
+			c.applyLock.Unlock()
+			return nil, fmt.Errorf("%s: get peer statuses: %w", n.network, err)
+		}
+		stale := n.stalePeers(statuses, now)
+		if len(stale) != 0 {
+			stales = append(stales, staleNetwork{n: n, nc: n.nc, stale: stale})
+		}
+	}
+	c.applyLock.Unlock()
+	if len(stales) == 0 {
+		return nil, nil
+	}
+
+	// === choose other endpoints and forwarders ===
+	// choosing probes endpoints, so this is done without applyLock to not hold up reconciles
+	opts, err := c.choiceOptions()
+	if err != nil {
+		return nil, err
+	}
+	for i := range stales {
+		sn := &stales[i]
+		nc := *sn.nc
+		nc.Devices = slices.Clone(nc.Devices)
+		sn.failedOver, err = sn.n.failoverPeers(&nc, sn.stale, opts, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sn.n.network, err)
+		}
+		if len(sn.failedOver) != 0 {
+			sn.newNC = &nc
+		}
+	}
+
+	// === apply ===
+	type changedNetwork struct {
+		n        *networkClient
+		nc       spec.NetworkCensored
+		revision uint64
+	}
+	var failedOver []string
+	var changed []changedNetwork
+	c.applyLock.Lock()
+	if c.tornDown {
+		c.applyLock.Unlock()
+		return nil, nil
+	}
+	for _, sn := range stales {
+		if sn.newNC == nil {
+			continue
+		}
+		if sn.n.nc != sn.nc {
+			// reconciled while choosing, which chose endpoints and forwarders again (excluding the failed ones)
+			zap.S().Infof("%s: spec changed while failing over, skip.", sn.n.network)
+			continue
+		}
+		sn.n.nc = sn.newNC
+		changed = append(changed, changedNetwork{sn.n, *sn.newNC, sn.n.revision})
+		for _, name := range sn.failedOver {
+			failedOver = append(failedOver, sn.n.network+"/"+name)
+		}
+	}
+	if len(changed) == 0 {
+		c.applyLock.Unlock()
+		return nil, nil
+	}
+	err = c.applyNoLock()
+	c.applyLock.Unlock()
+	if err != nil {
+		return failedOver, err
+	}
+	for _, cn := range changed {
+		_, err := cn.n.postReifyStatus(cn.nc, cn.revision)
+		if err != nil {
+			return failedOver, fmt.Errorf("%s: post status: %w", cn.n.network, err)
+		}
+	}
+	return failedOver, nil
+}
+
+// failoverPeers fails over the stale devices (indices in nc.Devices), and the devices using them as forwarders if needed.
+// It returns the names of the devices failed over.
+func (n *networkClient) failoverPeers(nc *spec.NetworkCensored, stale []int, opts choiceOptions, now time.Time) ([]string, error) {
+	var failedOver []string
+	for _, i := range stale {
+		ok, err := n.failoverPeer(nc, i, opts, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", nc.Devices[i].Name, err)
+		}
+		if ok {
+			failedOver = append(failedOver, nc.Devices[i].Name)
+			continue
+		}
+		// the peer is unreachable, so it cannot forward either
+		n.choicesLock.Lock()
+		if n.failedForwarders == nil {
+			n.failedForwarders = map[string]time.Time{}
+		}
+		n.failedForwarders[nc.Devices[i].Name] = now
+		n.choicesLock.Unlock()
+		for j, ndc := range nc.Devices {
+			if !ndc.ForwarderAndEndpointChosen || !ndc.UsesForwarder || ndc.ForwarderChosenIndex != i {
+				continue
+			}
+			ok, err := n.chooseForwarder(nc, j, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", ndc.Name, err)
+			}
+			if ok {
+				zap.S().Infof("%s/%s: failed over from forwarder %s to %s.", n.network, ndc.Name, nc.Devices[i].Name, nc.Devices[nc.Devices[j].ForwarderChosenIndex].Name)
+				failedOver = append(failedOver, ndc.Name)
+			}
+		}
+	}
+	return failedOver, nil
+}
+
+// stalePeers returns the indices (in n.nc.Devices) of the devices reached through an endpoint that are unreachable: packets were sent to them since the last check, but none were received, and there has been no handshake for staleHandshakeAfter.
+// This records statuses for the next check.
+func (n *networkClient) stalePeers(statuses map[goal.Key]goal.PeerStatus, now time.Time) []int {
+	prevStatuses := n.peerStatuses
+	n.peerStatuses = statuses
+	var stale []int
+	for i, ndc := range n.nc.Devices {
+		if ndc.Name == n.device || !ndc.ForwarderAndEndpointChosen || ndc.UsesForwarder {
+			continue
+		}
+		status, ok := statuses[ndc.PublicKey]
+		if !ok {
+			continue
+		}
+		prev, ok := prevStatuses[ndc.PublicKey]
+		if !ok {
+			continue
+		}
+		if status.TransmitBytes > prev.TransmitBytes && status.ReceiveBytes == prev.ReceiveBytes && now.Sub(status.LastHandshakeTime) > staleHandshakeAfter {
+			zap.S().Infof("%s/%s: no handshake since %s.", n.network, ndc.Name, status.LastHandshakeTime)
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// failoverPeer marks the endpoint chosen for the i-th device as failed, and chooses another endpoint (or a forwarder) for it.
+// It returns false (without changing nc) if there is nothing else to choose.
+func (n *networkClient) failoverPeer(nc *spec.NetworkCensored, i int, opts choiceOptions, now time.Time) (bool, error) {
+	ndc := &nc.Devices[i]
+	failed := ndc.Endpoints[ndc.EndpointChosenIndex]
+	n.choicesLock.Lock()
+	if n.failedEndpoints == nil {
+		n.failedEndpoints = map[string]time.Time{}
+	}
+	n.failedEndpoints[failed.Address] = now
+	n.choicesLock.Unlock()
+
+	err := ndc.ChooseEndpoint(n.excludeFailed(opts.scorer), opts.localAddrs)
+	if err == nil {
+		zap.S().Infof("%s/%s: failed over from endpoint %s to %s.", n.network, ndc.Name, failed, ndc.Endpoints[ndc.EndpointChosenIndex])
+		return true, nil
+	}
+	if !errors.Is(err, spec.ErrAllEndpointsBad) {
+		return false, fmt.Errorf("choose endpoint: %w", err)
+	}
+	ok, err := n.chooseForwarder(nc, i, opts)
+	if err != nil {
+		return false, fmt.Errorf("choose forwarder: %w", err)
+	}
+	if ok {
+		zap.S().Infof("%s/%s: failed over from endpoint %s to forwarder %s.", n.network, ndc.Name, failed, nc.Devices[ndc.ForwarderChosenIndex].Name)
+		return true, nil
+	}
+	// keep the current endpoint (and choose it again on the next reconcile), in case it works again
+	n.choicesLock.Lock()
+	delete(n.failedEndpoints, failed.Address)
+	n.choicesLock.Unlock()
+	zap.S().Warnf("%s/%s: endpoint %s does not work, but there is nothing else to fail over to.", n.network, ndc.Name, failed)
+	return false, nil
+}
+
+// forwarderHealthy returns whether the forwarder has not been found to not work within failedEndpointExpiry (see Client.Failover).
+func (n *networkClient) forwarderHealthy(forwarder spec.NetworkDeviceCensored) bool {
+	n.choicesLock.Lock()
+	defer n.choicesLock.Unlock()
+	if failedAt, ok := n.failedForwarders[forwarder.Name]; ok {
+		if time.Since(failedAt) < failedEndpointExpiry {
+			return false
+		}
+		delete(n.failedForwarders, forwarder.Name)
+	}
+	if forwarder.ForwarderAndEndpointChosen && !forwarder.UsesForwarder {
+		failedAt, ok := n.failedEndpoints[forwarder.Endpoints[forwarder.EndpointChosenIndex].Address]
+		if ok && time.Since(failedAt) < failedEndpointExpiry {
+			return false
+		}
+	}
+	return true
+}
+
+// excludeFailed returns a scorer that returns an error for endpoints that failed within failedEndpointExpiry, and uses scorer for others.
+func (n *networkClient) excludeFailed(scorer spec.EndpointScorer) spec.EndpointScorer {
+	return func(endpoint string) (int, error) {
+		n.choicesLock.Lock()
+		failedAt, ok := n.failedEndpoints[endpoint]
+		if ok && time.Since(failedAt) >= failedEndpointExpiry {
+			delete(n.failedEndpoints, endpoint)
+			ok = false
+		}
+		n.choicesLock.Unlock()
+		if ok {
+			return 0, fmt.Errorf("endpoint failed at %s", failedAt)
+		}
+		return scorer(endpoint)
+	}
+}
+
+// peerChoices returns the endpoint or forwarder chosen for each peer in nc.
+func (n *networkClient) peerChoices(nc spec.NetworkCensored) []coord.PeerChoice {
+	choices := []coord.PeerChoice{}
+	for _, ndc := range nc.Devices {
+		if ndc.Name == n.device || !ndc.ForwarderAndEndpointChosen {
+			continue
+		}
+		choice := coord.PeerChoice{Peer: ndc.Name}
+		if ndc.UsesForwarder {
+			choice.Forwarder = nc.Devices[ndc.ForwarderChosenIndex].Name
+		} else {
+			choice.Endpoint = ndc.Endpoints[ndc.EndpointChosenIndex].Address
+		}
+		choices = append(choices, choice)
+	}
+	return choices
+}
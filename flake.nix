@@ -80,7 +80,10 @@
               common
               // {
                 pname = "coord-server";
-                subPackages = [ "cmd/coord-server" ];
+                subPackages = [
+                  "cmd/coord-server"
+                  "cmd/validate-spec"
+                ];
               }
             );
             device = pkgs.buildGoModule (
@@ -0,0 +1,64 @@
+package goal
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// MaxInterfaceNameLength is the maximum length of an interface name on Linux.
+const MaxInterfaceNameLength = 15
+
+type Applier struct {
+	backend Backend
+	// ownedInterfaces are the interfaces created by the Applier (as opposed to existing interfaces used by a Machine).
+	// Only these are deleted when they are not in a Machine anymore.
+	ownedInterfaces []string
+	readWriteProc   bool
+	// sysctlOriginals are the values of sysctls before the Applier changed them.
+	sysctlOriginals map[string]string
+	// routeTables is the routing table routes were last added to for each interface, if not the main table.
+	// Routes are removed from this table when Interface.Table is changed.
+	routeTables map[string]int
+	// statePath is the path to save ApplierState to, or blank to not save it.
+	statePath string
+}
+
+// NewApplier returns an Applier using opt.Backend, or the system's backend if opt.Backend is nil.
+// If opt.StatePath is set, the state saved there (if any) is loaded.
+func NewApplier(opt ApplierOptions) (*Applier, error) {
+	var a *Applier
+	if opt.Backend == nil {
+		var err error
+		a, err = newSystemApplier(opt)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		a = &Applier{
+			backend:       opt.Backend,
+			readWriteProc: opt.Linux.ReadWriteProc,
+		}
+	}
+	if opt.StatePath != "" {
+		a.statePath = opt.StatePath
+		err := a.loadState()
+		if err != nil {
+			return nil, fmt.Errorf("loading state: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// ApplyMachine applies the given Machine to the system.
+// This is equivalent to calling Plan and then ApplyPlan.
+// If a step fails, the steps already taken are undone (see ApplyPlan), so the system is left as it was unless the rollback fails too.
+// (Assuming the error is temporary, you can just rerun this function to get to your goal state.)
+func (a *Applier) ApplyMachine(m Machine) error {
+	p, err := a.Plan(m)
+	if err != nil {
+		return err
+	}
+	zap.S().Debugf("applying plan:\n%s", p)
+	return a.ApplyPlan(p)
+}
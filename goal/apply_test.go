@@ -0,0 +1,145 @@
+package goal
+
+import (
+	"net"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustIPNet(t *testing.T, s string) IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return IPNet(*ipNet)
+}
+
+func mustKey(t *testing.T) Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key(key)
+}
+
+func TestApplyMachine(t *testing.T) {
+	backend := new(FakeBackend)
+	backend.SetSysctl("net/ipv4/ip_forward", "0")
+	a, err := NewApplier(ApplierOptions{Backend: backend, Linux: ApplierOptionsLinux{ReadWriteProc: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := mustKey(t)
+	peerKey := wgtypes.Key(mustKey(t)).PublicKey()
+	m := Machine{
+		Interfaces: []Interface{{
+			Name:       "qrystal0",
+			PrivateKey: privateKey,
+			ListenPort: 51820,
+			Addresses:  []IPNet{mustIPNet(t, "10.10.0.1/32")},
+			Peers: []InterfacePeer{{
+				Name:       "b",
+				PublicKey:  Key(peerKey),
+				Endpoint:   "127.0.0.1:51820",
+				AllowedIPs: []IPNet{mustIPNet(t, "10.10.0.2/32")},
+			}},
+		}},
+		ForwardsIPv4: true,
+	}
+	err = a.ApplyMachine(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, ok := backend.Link("qrystal0")
+	if !ok {
+		t.Fatal("interface not created")
+	}
+	if !link.Up {
+		t.Fatal("interface not up")
+	}
+	if link.Device.PrivateKey != wgtypes.Key(privateKey) || link.Device.ListenPort != 51820 {
+		t.Fatalf("interface not configured: %#v", link.Device)
+	}
+	if len(link.Device.Peers) != 1 || link.Device.Peers[0].PublicKey != peerKey || link.Device.Peers[0].Endpoint.String() != "127.0.0.1:51820" {
+		t.Fatalf("unexpected peers: %#v", link.Device.Peers)
+	}
+	if len(link.Addresses) != 1 || !equalIPNet(link.Addresses[0], mustIPNet(t, "10.10.0.1/32")) {
+		t.Fatalf("unexpected addresses: %v", link.Addresses)
+	}
+	if len(link.Routes) != 1 || !equalIPNet(link.Routes[0], mustIPNet(t, "10.10.0.2/32")) {
+		t.Fatalf("unexpected routes: %v", link.Routes)
+	}
+	if value, _ := backend.Sysctl("net/ipv4/ip_forward"); value != "1" {
+		t.Fatalf("ip_forward not enabled: %s", value)
+	}
+
+	// change address and remove peer
+	m.Interfaces[0].Addresses = []IPNet{mustIPNet(t, "10.10.0.3/32")}
+	m.Interfaces[0].Peers = nil
+	err = a.ApplyMachine(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, _ = backend.Link("qrystal0")
+	if len(link.Addresses) != 1 || !equalIPNet(link.Addresses[0], mustIPNet(t, "10.10.0.3/32")) {
+		t.Fatalf("unexpected addresses after update: %v", link.Addresses)
+	}
+	if len(link.Device.Peers) != 0 || len(link.Routes) != 0 {
+		t.Fatalf("peer not removed: peers %v, routes %v", link.Device.Peers, link.Routes)
+	}
+
+	// remove interface
+	err = a.ApplyMachine(Machine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Link("qrystal0"); ok {
+		t.Fatal("interface not removed")
+	}
+	if value, _ := backend.Sysctl("net/ipv4/ip_forward"); value != "0" {
+		t.Fatalf("ip_forward not disabled: %s", value)
+	}
+}
+
+func TestApplyForwarding(t *testing.T) {
+	backend := new(FakeBackend)
+	backend.SetSysctl("net/ipv4/ip_forward", "1")
+	backend.SetSysctl("net/ipv6/conf/all/forwarding", "0")
+	a, err := NewApplier(ApplierOptions{Backend: backend, Linux: ApplierOptionsLinux{ReadWriteProc: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysctls := func() (string, string) {
+		v4, _ := backend.Sysctl("net/ipv4/ip_forward")
+		v6, _ := backend.Sysctl("net/ipv6/conf/all/forwarding")
+		return v4, v6
+	}
+
+	err = a.ApplyMachine(Machine{ForwardsIPv4: true, ForwardsIPv6: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v4, v6 := sysctls(); v4 != "1" || v6 != "1" {
+		t.Fatalf("forwarding not enabled: %s %s", v4, v6)
+	}
+
+	// restore the values from before qrystal needed forwarding
+	err = a.ApplyMachine(Machine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v4, v6 := sysctls(); v4 != "1" || v6 != "0" {
+		t.Fatalf("forwarding not restored: %s %s", v4, v6)
+	}
+
+	// forwarding enabled by someone else is left alone
+	backend.SetSysctl("net/ipv6/conf/all/forwarding", "1")
+	err = a.ApplyMachine(Machine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, v6 := sysctls(); v6 != "1" {
+		t.Fatalf("forwarding changed: %s", v6)
+	}
+}
@@ -0,0 +1,55 @@
+package goal
+
+import (
+	"errors"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ErrLinkNotFound is returned by a Backend when the link does not exist.
+var ErrLinkNotFound = errors.New("link not found")
+
+// OwnerAlias is the alias set on links created by an Applier, to tell them apart from links created by others.
+const OwnerAlias = "qrystal"
+
+// Backend performs the operations on the system needed to apply a Machine.
+// Links are referred to by name.
+type Backend interface {
+	// WireguardDevices returns the names of all WireGuard links.
+	WireguardDevices() ([]string, error)
+	// WireguardDevice returns the current configuration of the WireGuard link.
+	WireguardDevice(name string) (*wgtypes.Device, error)
+	// ConfigureWireguard configures the WireGuard link.
+	ConfigureWireguard(name string, cfg wgtypes.Config) error
+
+	// AddLink adds a WireGuard link.
+	AddLink(name string) error
+	// DeleteLink deletes the link.
+	DeleteLink(name string) error
+	// LinkUp returns whether the link is up.
+	LinkUp(name string) (bool, error)
+	// SetLinkUp sets the link up.
+	SetLinkUp(name string) error
+	// SetLinkDown sets the link down.
+	SetLinkDown(name string) error
+	// LinkAlias returns the alias (ifalias) of the link, or blank if none is set.
+	LinkAlias(name string) (string, error)
+	SetLinkAlias(name, alias string) error
+	// LinkMTU returns the MTU of the link.
+	LinkMTU(name string) (int, error)
+	SetLinkMTU(name string, mtu int) error
+
+	// AddrList returns the addresses of the link.
+	AddrList(name string) ([]IPNet, error)
+	AddrAdd(name string, addr IPNet) error
+	AddrDel(name string, addr IPNet) error
+
+	// RouteList returns the destinations of routes through the link in the routing table (0 for the main table).
+	RouteList(name string, table int) ([]IPNet, error)
+	RouteAdd(name string, dst IPNet, table int) error
+	RouteDel(name string, dst IPNet, table int) error
+
+	// ReadSysctl returns the value of the sysctl (e.g. net/ipv4/ip_forward), without surrounding whitespace.
+	ReadSysctl(key string) (string, error)
+	WriteSysctl(key, value string) error
+}
@@ -0,0 +1,255 @@
+//go:build linux
+
+package goal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// LinuxBackend is a Backend using netlink, wgctrl, and /proc/sys.
+type LinuxBackend struct {
+	client *wgctrl.Client
+	handle *netlink.Handle
+}
+
+var _ Backend = (*LinuxBackend)(nil)
+
+// NewLinuxBackend returns a LinuxBackend.
+// If client or handle is nil, a new one is created.
+func NewLinuxBackend(client *wgctrl.Client, handle *netlink.Handle) (*LinuxBackend, error) {
+	var err error
+	if client == nil {
+		client, err = wgctrl.New()
+		if err != nil {
+			return nil, fmt.Errorf("creating wgctrl client: %w", err)
+		}
+	}
+	if handle == nil {
+		handle, err = netlink.NewHandle()
+		if err != nil {
+			return nil, fmt.Errorf("creating netlink handle: %w", err)
+		}
+	}
+	return &LinuxBackend{client: client, handle: handle}, nil
+}
+
+func newSystemApplier(opt ApplierOptions) (*Applier, error) {
+	return NewApplierLinux(nil, nil, nil, opt.Linux.ReadWriteProc)
+}
+
+// NewApplierLinux returns an Applier using a LinuxBackend.
+// ownedInterfaces are interfaces to treat as created by the Applier (see ApplierState.OwnedInterfaces).
+func NewApplierLinux(client *wgctrl.Client, handle *netlink.Handle, ownedInterfaces []string, readWriteProc bool) (*Applier, error) {
+	backend, err := NewLinuxBackend(client, handle)
+	if err != nil {
+		return nil, err
+	}
+	return &Applier{
+		backend:         backend,
+		ownedInterfaces: ownedInterfaces,
+		readWriteProc:   readWriteProc,
+	}, nil
+}
+
+func (b *LinuxBackend) WireguardDevices() ([]string, error) {
+	devices, err := b.client.Devices()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(devices))
+	for i, device := range devices {
+		names[i] = device.Name
+	}
+	return names, nil
+}
+
+func (b *LinuxBackend) WireguardDevice(name string) (*wgtypes.Device, error) {
+	device, err := b.client.Device(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", name, ErrLinkNotFound)
+	}
+	return device, err
+}
+
+func (b *LinuxBackend) ConfigureWireguard(name string, cfg wgtypes.Config) error {
+	return b.client.ConfigureDevice(name, cfg)
+}
+
+func (b *LinuxBackend) linkByName(name string) (netlink.Link, error) {
+	link, err := b.handle.LinkByName(name)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, fmt.Errorf("%s: %w", name, ErrLinkNotFound)
+	}
+	return link, err
+}
+
+func (b *LinuxBackend) AddLink(name string) error {
+	// emulates PR #464 (not landed in stable yet)
+	// https://github.com/xaionaro-go/netlink/blob/fdd1f99835f135fb252d9e6fedd004c4b81601fd/link.go
+	// ip link add dev <name> type wireguard
+	return b.handle.LinkAdd(&netlink.GenericLink{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+		},
+		LinkType: "wireguard",
+	})
+}
+
+func (b *LinuxBackend) DeleteLink(name string) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.LinkDel(link)
+}
+
+func (b *LinuxBackend) LinkUp(name string) (bool, error) {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return false, err
+	}
+	return link.Attrs().Flags&net.FlagUp != 0, nil
+}
+
+func (b *LinuxBackend) SetLinkUp(name string) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.LinkSetUp(link)
+}
+
+func (b *LinuxBackend) SetLinkDown(name string) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.LinkSetDown(link)
+}
+
+func (b *LinuxBackend) LinkAlias(name string) (string, error) {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return "", err
+	}
+	return link.Attrs().Alias, nil
+}
+
+func (b *LinuxBackend) SetLinkAlias(name, alias string) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.LinkSetAlias(link, alias)
+}
+
+func (b *LinuxBackend) LinkMTU(name string) (int, error) {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return link.Attrs().MTU, nil
+}
+
+func (b *LinuxBackend) SetLinkMTU(name string, mtu int) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.LinkSetMTU(link, mtu)
+}
+
+func (b *LinuxBackend) AddrList(name string) ([]IPNet, error) {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := b.handle.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+	addrs2 := make([]IPNet, len(addrs))
+	for i, addr := range addrs {
+		addrs2[i] = IPNet(*addr.IPNet)
+	}
+	return addrs2, nil
+}
+
+func (b *LinuxBackend) AddrAdd(name string, addr IPNet) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.AddrAdd(link, &netlink.Addr{IPNet: (*net.IPNet)(&addr)})
+}
+
+func (b *LinuxBackend) AddrDel(name string, addr IPNet) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.AddrDel(link, &netlink.Addr{IPNet: (*net.IPNet)(&addr)})
+}
+
+func (b *LinuxBackend) RouteList(name string, table int) ([]IPNet, error) {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	var routes []netlink.Route
+	if table == 0 {
+		routes, err = b.handle.RouteList(link, netlink.FAMILY_ALL)
+	} else {
+		routes, err = b.handle.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{LinkIndex: link.Attrs().Index, Table: table}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dsts := make([]IPNet, 0, len(routes))
+	for _, route := range routes {
+		if route.Dst == nil {
+			// default route
+			continue
+		}
+		dsts = append(dsts, IPNet(*route.Dst))
+	}
+	return dsts, nil
+}
+
+func (b *LinuxBackend) RouteAdd(name string, dst IPNet, table int) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: (*net.IPNet)(&dst), Table: table})
+}
+
+func (b *LinuxBackend) RouteDel(name string, dst IPNet, table int) error {
+	link, err := b.linkByName(name)
+	if err != nil {
+		return err
+	}
+	return b.handle.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: (*net.IPNet)(&dst), Table: table})
+}
+
+func (b *LinuxBackend) ReadSysctl(key string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/proc/sys", key))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (b *LinuxBackend) WriteSysctl(key, value string) error {
+	return os.WriteFile(filepath.Join("/proc/sys", key), []byte(value), 0444)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package goal
+
+import (
+	"errors"
+	"runtime"
+)
+
+func newSystemApplier(opt ApplierOptions) (*Applier, error) {
+	return nil, errors.New("goal: no backend for " + runtime.GOOS + "; set ApplierOptions.Backend")
+}
@@ -0,0 +1,449 @@
+package goal
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"slices"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FakeBackend is an in-memory Backend for testing.
+// The zero value is an empty system with no links and no sysctls.
+type FakeBackend struct {
+	lock     sync.Mutex
+	links    map[string]*FakeLink
+	sysctls  map[string]string
+	failures map[string]error
+}
+
+var _ Backend = (*FakeBackend)(nil)
+
+// FakeLink is the state of a link in a FakeBackend.
+type FakeLink struct {
+	Up        bool
+	Alias     string
+	MTU       int
+	Device    wgtypes.Device
+	Addresses []IPNet
+	// Routes are the routes in the main routing table.
+	Routes []IPNet
+	// TableRoutes are the routes in other routing tables, by table.
+	TableRoutes map[int][]IPNet
+}
+
+func (f *FakeBackend) initNoLock() {
+	if f.links == nil {
+		f.links = map[string]*FakeLink{}
+	}
+	if f.sysctls == nil {
+		f.sysctls = map[string]string{}
+	}
+}
+
+// Link returns a copy of the state of the link.
+func (f *FakeBackend) Link(name string) (link FakeLink, ok bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	l, ok := f.links[name]
+	if !ok {
+		return FakeLink{}, false
+	}
+	link = *l
+	link.Device.Peers = slices.Clone(l.Device.Peers)
+	link.Addresses = slices.Clone(l.Addresses)
+	link.Routes = slices.Clone(l.Routes)
+	link.TableRoutes = map[int][]IPNet{}
+	for table, routes := range l.TableRoutes {
+		link.TableRoutes[table] = slices.Clone(routes)
+	}
+	return link, true
+}
+
+// Sysctl returns the value of the sysctl.
+func (f *FakeBackend) Sysctl(key string) (value string, ok bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	value, ok = f.sysctls[key]
+	return
+}
+
+// SetSysctl sets the value of the sysctl, e.g. to emulate the system's initial state.
+func (f *FakeBackend) SetSysctl(key, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.initNoLock()
+	f.sysctls[key] = value
+}
+
+// UpdatePeer calls update with the peer of the link, e.g. to emulate handshakes and traffic.
+// It returns false if the link or peer does not exist.
+func (f *FakeBackend) UpdatePeer(name string, publicKey wgtypes.Key, update func(peer *wgtypes.Peer)) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	link, ok := f.links[name]
+	if !ok {
+		return false
+	}
+	i := slices.IndexFunc(link.Device.Peers, func(p wgtypes.Peer) bool { return p.PublicKey == publicKey })
+	if i == -1 {
+		return false
+	}
+	update(&link.Device.Peers[i])
+	return true
+}
+
+// FailOn makes the next call to the named method (e.g. "RouteAdd") fail with err, without changing anything.
+// Only methods that change the system can be made to fail.
+func (f *FakeBackend) FailOn(method string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failures == nil {
+		f.failures = map[string]error{}
+	}
+	f.failures[method] = err
+}
+
+func (f *FakeBackend) failureNoLock(method string) error {
+	err := f.failures[method]
+	delete(f.failures, method)
+	return err
+}
+
+func (f *FakeBackend) linkNoLock(name string) (*FakeLink, error) {
+	link, ok := f.links[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrLinkNotFound)
+	}
+	return link, nil
+}
+
+func (f *FakeBackend) WireguardDevices() ([]string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	names := make([]string, 0, len(f.links))
+	for name := range f.links {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (f *FakeBackend) WireguardDevice(name string) (*wgtypes.Device, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return nil, err
+	}
+	device := link.Device
+	device.Peers = slices.Clone(link.Device.Peers)
+	return &device, nil
+}
+
+func (f *FakeBackend) ConfigureWireguard(name string, cfg wgtypes.Config) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("ConfigureWireguard"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	d := &link.Device
+	if cfg.PrivateKey != nil {
+		d.PrivateKey = *cfg.PrivateKey
+		d.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		d.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		d.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		d.Peers = nil
+	}
+	for _, pc := range cfg.Peers {
+		i := slices.IndexFunc(d.Peers, func(p wgtypes.Peer) bool { return p.PublicKey == pc.PublicKey })
+		if pc.Remove {
+			if i != -1 {
+				d.Peers = slices.Delete(d.Peers, i, i+1)
+			}
+			continue
+		}
+		if i == -1 {
+			if pc.UpdateOnly {
+				continue
+			}
+			d.Peers = append(d.Peers, wgtypes.Peer{PublicKey: pc.PublicKey})
+			i = len(d.Peers) - 1
+		}
+		p := &d.Peers[i]
+		if pc.PresharedKey != nil {
+			p.PresharedKey = *pc.PresharedKey
+		}
+		if pc.Endpoint != nil {
+			p.Endpoint = pc.Endpoint
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			p.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			p.AllowedIPs = nil
+		}
+		p.AllowedIPs = append(slices.Clone(p.AllowedIPs), pc.AllowedIPs...)
+	}
+	return nil
+}
+
+func (f *FakeBackend) AddLink(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("AddLink"); err != nil {
+		return err
+	}
+	f.initNoLock()
+	if _, ok := f.links[name]; ok {
+		return fmt.Errorf("link %s already exists", name)
+	}
+	f.links[name] = &FakeLink{MTU: 1420, Device: wgtypes.Device{Name: name, Type: wgtypes.LinuxKernel}, TableRoutes: map[int][]IPNet{}}
+	return nil
+}
+
+func (f *FakeBackend) DeleteLink(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("DeleteLink"); err != nil {
+		return err
+	}
+	if _, err := f.linkNoLock(name); err != nil {
+		return err
+	}
+	delete(f.links, name)
+	return nil
+}
+
+func (f *FakeBackend) LinkUp(name string) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return false, err
+	}
+	return link.Up, nil
+}
+
+func (f *FakeBackend) SetLinkUp(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("SetLinkUp"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	link.Up = true
+	return nil
+}
+
+func (f *FakeBackend) SetLinkDown(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("SetLinkDown"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	link.Up = false
+	return nil
+}
+
+func (f *FakeBackend) LinkAlias(name string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return "", err
+	}
+	return link.Alias, nil
+}
+
+func (f *FakeBackend) SetLinkAlias(name, alias string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("SetLinkAlias"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	link.Alias = alias
+	return nil
+}
+
+func (f *FakeBackend) LinkMTU(name string) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return 0, err
+	}
+	return link.MTU, nil
+}
+
+func (f *FakeBackend) SetLinkMTU(name string, mtu int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("SetLinkMTU"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	link.MTU = mtu
+	return nil
+}
+
+func (f *FakeBackend) AddrList(name string) ([]IPNet, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(link.Addresses), nil
+}
+
+func (f *FakeBackend) AddrAdd(name string, addr IPNet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("AddrAdd"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	return addIPNet(&link.Addresses, addr)
+}
+
+func (f *FakeBackend) AddrDel(name string, addr IPNet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("AddrDel"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	return delIPNet(&link.Addresses, addr)
+}
+
+func (f *FakeBackend) RouteList(name string, table int) ([]IPNet, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(*link.routes(table)), nil
+}
+
+func (f *FakeBackend) RouteAdd(name string, dst IPNet, table int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("RouteAdd"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	routes := link.routes(table)
+	err = addIPNet(routes, dst)
+	if table != 0 {
+		link.TableRoutes[table] = *routes
+	}
+	return err
+}
+
+func (f *FakeBackend) RouteDel(name string, dst IPNet, table int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("RouteDel"); err != nil {
+		return err
+	}
+	link, err := f.linkNoLock(name)
+	if err != nil {
+		return err
+	}
+	routes := link.routes(table)
+	err = delIPNet(routes, dst)
+	if table != 0 {
+		link.TableRoutes[table] = *routes
+	}
+	return err
+}
+
+// routes returns the routes in the routing table.
+func (l *FakeLink) routes(table int) *[]IPNet {
+	if table == 0 {
+		return &l.Routes
+	}
+	routes := l.TableRoutes[table]
+	return &routes
+}
+
+func (f *FakeBackend) ReadSysctl(key string) (string, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	value, ok := f.sysctls[key]
+	if !ok {
+		return "", fmt.Errorf("sysctl %s: %w", key, fs.ErrNotExist)
+	}
+	return value, nil
+}
+
+func (f *FakeBackend) WriteSysctl(key, value string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.failureNoLock("WriteSysctl"); err != nil {
+		return err
+	}
+	if _, ok := f.sysctls[key]; !ok {
+		return fmt.Errorf("sysctl %s: %w", key, fs.ErrNotExist)
+	}
+	f.sysctls[key] = value
+	return nil
+}
+
+func equalIPNet(a, b IPNet) bool {
+	return !lessIPNet(a, b) && !lessIPNet(b, a)
+}
+
+func addIPNet(s *[]IPNet, x IPNet) error {
+	if slices.ContainsFunc(*s, func(y IPNet) bool { return equalIPNet(x, y) }) {
+		return fmt.Errorf("%s already exists", (*net.IPNet)(&x))
+	}
+	*s = append(*s, x)
+	return nil
+}
+
+func delIPNet(s *[]IPNet, x IPNet) error {
+	i := slices.IndexFunc(*s, func(y IPNet) bool { return equalIPNet(x, y) })
+	if i == -1 {
+		return fmt.Errorf("%s not found", (*net.IPNet)(&x))
+	}
+	*s = slices.Delete(*s, i, i+1)
+	return nil
+}
@@ -1,12 +1,13 @@
 // Package goal provides a goal-based library for configuring WireGuard devices and routing.
-// Note: only IPv4 supported yet.
 
 package goal
 
 type Machine struct {
-	Interfaces   []Interface
-	ForwardsIPv4 bool
-	ForwardsIPv6 bool
+	Interfaces []Interface
+	// KeepInterfaces are the names of interfaces left as they are, even if they were created by the Applier and are not in Interfaces (e.g. interfaces of networks whose spec has not been received yet).
+	KeepInterfaces []string `json:",omitempty"`
+	ForwardsIPv4   bool
+	ForwardsIPv6   bool
 }
 
 type Interface struct {
@@ -19,6 +20,18 @@ type Interface struct {
 
 	Addresses []IPNet
 
+	// MTU is the MTU of the link.
+	// Set to 0 to leave the MTU as is (WireGuard defaults to 1420).
+	MTU int
+
+	// FirewallMark is the fwmark set on packets sent by WireGuard.
+	// Set to 0 for no fwmark.
+	FirewallMark int
+
+	// Table is the routing table to add routes for peers' AllowedIPs to.
+	// Set to 0 for the main table.
+	Table int
+
 	Peers []InterfacePeer
 
 	// Broken is true if the interface a) has an address that is not assigned with ip, b) has a peer with an AllowedIPs that is not assigned with ip.
@@ -44,7 +57,14 @@ type InterfacePeer struct {
 }
 
 type ApplierOptions struct {
-	Linux ApplierOptionsLinux
+	// Backend performs the operations on the system.
+	// Leave nil to use the system's backend (e.g. LinuxBackend on Linux).
+	Backend Backend
+	// StatePath is the path to a file to persist the Applier's state in (see ApplierState).
+	// This lets a later Applier clean up interfaces left behind (e.g. after a crash).
+	// Leave blank to keep the state in memory only.
+	StatePath string
+	Linux     ApplierOptionsLinux
 }
 
 type ApplierOptionsLinux struct {
@@ -0,0 +1,283 @@
+package goal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Observe reads the current state of the named WireGuard interfaces (or all of them, if names is nil) into a Machine.
+// Peer names are not stored on the system, so they are left blank.
+// Interface.Broken is set if a peer's AllowedIPs are not routed through the interface (in the main routing table).
+// Forwarding is only read if the Applier reads and writes /proc (see ApplierOptionsLinux).
+func (a *Applier) Observe(names []string) (Machine, error) {
+	return a.observe(names, nil, false)
+}
+
+// observe is like Observe, but routes are looked for in tables[name] for each interface.
+// If needIPv6 is true, a missing IPv6 forwarding sysctl (i.e. IPv6 is disabled) is an error, as IPv6 forwarding cannot be enabled.
+func (a *Applier) observe(names []string, tables map[string]int, needIPv6 bool) (Machine, error) {
+	if names == nil {
+		var err error
+		names, err = a.backend.WireguardDevices()
+		if err != nil {
+			return Machine{}, fmt.Errorf("getting wg devices: %w", err)
+		}
+	}
+	var m Machine
+	for _, name := range names {
+		iface, err := a.observeInterface(name, tables[name])
+		if err != nil {
+			return Machine{}, fmt.Errorf("observing interface %s: %w", name, err)
+		}
+		m.Interfaces = append(m.Interfaces, iface)
+	}
+	if a.readWriteProc {
+		raw, err := a.backend.ReadSysctl(sysctlForwardIPv4)
+		if err != nil {
+			return Machine{}, fmt.Errorf("reading %s: %w", sysctlForwardIPv4, err)
+		}
+		m.ForwardsIPv4 = raw == "1"
+		raw, err = a.backend.ReadSysctl(sysctlForwardIPv6)
+		if errors.Is(err, fs.ErrNotExist) && !needIPv6 {
+			// IPv6 disabled
+		} else if err != nil {
+			return Machine{}, fmt.Errorf("reading %s: %w", sysctlForwardIPv6, err)
+		}
+		m.ForwardsIPv6 = raw == "1"
+	}
+	return m, nil
+}
+
+func (a *Applier) observeInterface(name string, table int) (Interface, error) {
+	device, err := a.backend.WireguardDevice(name)
+	if err != nil {
+		return Interface{}, fmt.Errorf("getting wg device: %w", err)
+	}
+	addrs, err := a.backend.AddrList(name)
+	if err != nil {
+		return Interface{}, fmt.Errorf("listing addresses: %w", err)
+	}
+	routes, err := a.backend.RouteList(name, table)
+	if err != nil {
+		return Interface{}, fmt.Errorf("listing routes: %w", err)
+	}
+	mtu, err := a.backend.LinkMTU(name)
+	if err != nil {
+		return Interface{}, fmt.Errorf("getting MTU: %w", err)
+	}
+	iface := Interface{
+		Name:         name,
+		PrivateKey:   Key(device.PrivateKey),
+		ListenPort:   device.ListenPort,
+		Addresses:    addrs,
+		MTU:          mtu,
+		FirewallMark: device.FirewallMark,
+		Table:        table,
+	}
+	for _, peer := range device.Peers {
+		ip := InterfacePeer{
+			PublicKey:           Key(peer.PublicKey),
+			PersistentKeepalive: Duration(peer.PersistentKeepaliveInterval),
+		}
+		if peer.PresharedKey != (wgtypes.Key{}) {
+			presharedKey := Key(peer.PresharedKey)
+			ip.PresharedKey = &presharedKey
+		}
+		if peer.Endpoint != nil {
+			ip.Endpoint = peer.Endpoint.String()
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			ip.AllowedIPs = append(ip.AllowedIPs, IPNet(allowedIP))
+			if !slices.ContainsFunc(routes, func(route IPNet) bool { return equalIPNet(route, IPNet(allowedIP)) }) {
+				iface.Broken = true
+			}
+		}
+		iface.Peers = append(iface.Peers, ip)
+	}
+	return iface, nil
+}
+
+// Drift is a difference between the desired and the observed state of the system.
+type Drift struct {
+	// Interface is the name of the interface that differs, or blank if the difference is not in an interface.
+	Interface string `json:",omitempty"`
+	// Field is the part that differs, e.g. ListenPort or Peers[<public key>].AllowedIPs.
+	Field    string
+	Desired  string
+	Observed string
+}
+
+func (d Drift) String() string {
+	path := d.Field
+	if d.Interface != "" {
+		path = d.Interface + "." + d.Field
+	}
+	return fmt.Sprintf("%s: desired %s, observed %s", path, d.Desired, d.Observed)
+}
+
+// CompareMachines returns the differences between the desired and the observed machine (e.g. from Observe).
+// Interfaces are matched by name, and peers by public key.
+// Peer endpoints are not compared, as WireGuard updates them when peers roam. Private keys are compared, but only public keys are reported.
+func CompareMachines(desired, observed Machine) []Drift {
+	var drifts []Drift
+	add := func(iface, field string, desired, observed any) {
+		drifts = append(drifts, Drift{Interface: iface, Field: field, Desired: fmt.Sprint(desired), Observed: fmt.Sprint(observed)})
+	}
+	for _, di := range desired.Interfaces {
+		i := slices.IndexFunc(observed.Interfaces, func(oi Interface) bool { return oi.Name == di.Name })
+		if i == -1 {
+			add(di.Name, "", "present", "absent")
+			continue
+		}
+		oi := observed.Interfaces[i]
+		if di.PrivateKey != oi.PrivateKey {
+			add(di.Name, "PrivateKey", publicKeyString(di.PrivateKey), publicKeyString(oi.PrivateKey))
+		}
+		if di.ListenPort != 0 && di.ListenPort != oi.ListenPort {
+			add(di.Name, "ListenPort", di.ListenPort, oi.ListenPort)
+		}
+		if di.MTU != 0 && di.MTU != oi.MTU {
+			add(di.Name, "MTU", di.MTU, oi.MTU)
+		}
+		if di.FirewallMark != oi.FirewallMark {
+			add(di.Name, "FirewallMark", di.FirewallMark, oi.FirewallMark)
+		}
+		if !equalIPNetSet(di.Addresses, oi.Addresses) {
+			add(di.Name, "Addresses", ipNetsString(di.Addresses), ipNetsString(oi.Addresses))
+		}
+		if oi.Broken {
+			add(di.Name, "Broken", false, true)
+		}
+		for _, dp := range di.Peers {
+			field := fmt.Sprintf("Peers[%s]", wgtypes.Key(dp.PublicKey))
+			j := slices.IndexFunc(oi.Peers, func(op InterfacePeer) bool { return op.PublicKey == dp.PublicKey })
+			if j == -1 {
+				add(di.Name, field, "present", "absent")
+				continue
+			}
+			op := oi.Peers[j]
+			if (dp.PresharedKey == nil) != (op.PresharedKey == nil) || dp.PresharedKey != nil && *dp.PresharedKey != *op.PresharedKey {
+				observedString := presharedKeyString(op.PresharedKey)
+				if dp.PresharedKey != nil && op.PresharedKey != nil {
+					observedString = "(different)"
+				}
+				add(di.Name, field+".PresharedKey", presharedKeyString(dp.PresharedKey), observedString)
+			}
+			if dp.PersistentKeepalive != op.PersistentKeepalive {
+				add(di.Name, field+".PersistentKeepalive", time.Duration(dp.PersistentKeepalive), time.Duration(op.PersistentKeepalive))
+			}
+			if !equalIPNetSet(dp.AllowedIPs, op.AllowedIPs) {
+				add(di.Name, field+".AllowedIPs", ipNetsString(dp.AllowedIPs), ipNetsString(op.AllowedIPs))
+			}
+		}
+		for _, op := range oi.Peers {
+			if !slices.ContainsFunc(di.Peers, func(dp InterfacePeer) bool { return dp.PublicKey == op.PublicKey }) {
+				add(di.Name, fmt.Sprintf("Peers[%s]", wgtypes.Key(op.PublicKey)), "absent", "present")
+			}
+		}
+	}
+	for _, oi := range observed.Interfaces {
+		if !slices.ContainsFunc(desired.Interfaces, func(di Interface) bool { return di.Name == oi.Name }) {
+			add(oi.Name, "", "absent", "present")
+		}
+	}
+	if desired.ForwardsIPv4 != observed.ForwardsIPv4 {
+		add("", "ForwardsIPv4", desired.ForwardsIPv4, observed.ForwardsIPv4)
+	}
+	if desired.ForwardsIPv6 != observed.ForwardsIPv6 {
+		add("", "ForwardsIPv6", desired.ForwardsIPv6, observed.ForwardsIPv6)
+	}
+	return drifts
+}
+
+// Drift observes the interfaces in m and the interfaces created by the Applier, and returns how they differ from m.
+func (a *Applier) Drift(m Machine) ([]Drift, error) {
+	deviceNames, err := a.backend.WireguardDevices()
+	if err != nil {
+		return nil, fmt.Errorf("getting wg devices: %w", err)
+	}
+	names := make([]string, 0)
+	tables := map[string]int{}
+	for _, iface := range m.Interfaces {
+		if slices.Contains(deviceNames, iface.Name) {
+			names = append(names, iface.Name)
+			tables[iface.Name] = iface.Table
+		}
+	}
+	for _, name := range a.ownedInterfaces {
+		if slices.Contains(deviceNames, name) && !slices.Contains(names, name) && !slices.Contains(m.KeepInterfaces, name) {
+			names = append(names, name)
+		}
+	}
+	observed, err := a.observe(names, tables, m.ForwardsIPv6)
+	if err != nil {
+		return nil, err
+	}
+	// forwarding not managed by the Applier (or enabled by someone else) is not drift
+	if !a.readWriteProc || !m.ForwardsIPv4 {
+		observed.ForwardsIPv4 = m.ForwardsIPv4
+	}
+	if !a.readWriteProc || !m.ForwardsIPv6 {
+		observed.ForwardsIPv6 = m.ForwardsIPv6
+	}
+	return CompareMachines(m, observed), nil
+}
+
+func equalIPNetSet(a, b []IPNet) bool {
+	return len(setDifference(slices.Clone(a), slices.Clone(b), lessIPNet)) == 0 && len(setDifference(slices.Clone(b), slices.Clone(a), lessIPNet)) == 0
+}
+
+func ipNetsString(ipNets []IPNet) string {
+	ss := make([]string, len(ipNets))
+	for i := range ipNets {
+		ss[i] = (*net.IPNet)(&ipNets[i]).String()
+	}
+	slices.Sort(ss)
+	return "[" + strings.Join(ss, " ") + "]"
+}
+
+func publicKeyString(privateKey Key) string {
+	if privateKey == (Key{}) {
+		return "none"
+	}
+	return fmt.Sprintf("(public key) %s", wgtypes.Key(privateKey).PublicKey())
+}
+
+func presharedKeyString(presharedKey *Key) string {
+	if presharedKey == nil {
+		return "none"
+	}
+	return "(set)"
+}
+
+// PeerStatus is the runtime status of a WireGuard peer.
+type PeerStatus struct {
+	// LastHandshakeTime is the time of the last handshake, or the zero time if there has been none.
+	LastHandshakeTime time.Time
+	ReceiveBytes      int64
+	TransmitBytes     int64
+}
+
+// PeerStatuses returns the runtime status of each peer of the named WireGuard interface, by public key.
+func (a *Applier) PeerStatuses(name string) (map[Key]PeerStatus, error) {
+	device, err := a.backend.WireguardDevice(name)
+	if err != nil {
+		return nil, fmt.Errorf("getting wg device: %w", err)
+	}
+	statuses := make(map[Key]PeerStatus, len(device.Peers))
+	for _, peer := range device.Peers {
+		statuses[Key(peer.PublicKey)] = PeerStatus{
+			LastHandshakeTime: peer.LastHandshakeTime,
+			ReceiveBytes:      peer.ReceiveBytes,
+			TransmitBytes:     peer.TransmitBytes,
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,86 @@
+package goal
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestObserve(t *testing.T) {
+	backend := new(FakeBackend)
+	backend.SetSysctl("net/ipv4/ip_forward", "0")
+	a, err := NewApplier(ApplierOptions{Backend: backend, Linux: ApplierOptionsLinux{ReadWriteProc: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerKey := Key(wgtypes.Key(mustKey(t)).PublicKey())
+	m := Machine{
+		Interfaces: []Interface{{
+			Name:       "qrystal0",
+			PrivateKey: mustKey(t),
+			ListenPort: 51820,
+			Addresses:  []IPNet{mustIPNet(t, "10.10.0.1/32")},
+			Peers: []InterfacePeer{{
+				Name:       "b",
+				PublicKey:  peerKey,
+				Endpoint:   "127.0.0.1:51820",
+				AllowedIPs: []IPNet{mustIPNet(t, "10.10.0.2/32")},
+			}},
+		}},
+		ForwardsIPv4: true,
+	}
+	err = a.ApplyMachine(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed, err := a.Observe(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observed.Interfaces) != 1 || observed.Interfaces[0].Name != "qrystal0" || !observed.ForwardsIPv4 {
+		t.Fatalf("unexpected machine: %#v", observed)
+	}
+	if peers := observed.Interfaces[0].Peers; len(peers) != 1 || peers[0].PublicKey != peerKey || peers[0].Endpoint != "127.0.0.1:51820" {
+		t.Fatalf("unexpected peers: %#v", peers)
+	}
+	if drifts := CompareMachines(m, observed); len(drifts) != 0 {
+		t.Fatalf("unexpected drift: %v", drifts)
+	}
+
+	// change the system behind the applier's back
+	err = backend.RouteDel("qrystal0", mustIPNet(t, "10.10.0.2/32"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.AddrAdd("qrystal0", mustIPNet(t, "10.10.0.9/32"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.AddLink("qrystal1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drifts, err := a.Drift(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// qrystal1 is not managed, so it is not reported
+	expected := map[string]bool{"qrystal0.Addresses": true, "qrystal0.Broken": true}
+	if len(drifts) != len(expected) {
+		t.Fatalf("unexpected drift: %v", drifts)
+	}
+	for _, d := range drifts {
+		if !expected[d.Interface+"."+d.Field] {
+			t.Fatalf("unexpected drift: %s", d)
+		}
+	}
+
+	// IPv6 is disabled, so IPv6 forwarding cannot be enabled (rather than drifting every time)
+	m.ForwardsIPv6 = true
+	_, err = a.Drift(m)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("IPv6 forwarding without IPv6: unexpected error %v", err)
+	}
+}
@@ -0,0 +1,596 @@
+package goal
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Plan is the list of steps needed to apply a Machine, as returned by Applier.Plan.
+type Plan struct {
+	Steps []Step
+}
+
+// Empty returns whether the plan has no steps (i.e. the system is already in the goal state).
+func (p Plan) Empty() bool {
+	return len(p.Steps) == 0
+}
+
+func (p Plan) String() string {
+	if p.Empty() {
+		return "no changes"
+	}
+	lines := make([]string, len(p.Steps))
+	for i, step := range p.Steps {
+		lines[i] = step.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type StepKind string
+
+const (
+	StepDeleteLink         StepKind = "delete-link"
+	StepAddLink            StepKind = "add-link"
+	StepConfigureWireguard StepKind = "configure-wireguard"
+	StepDeleteAddress      StepKind = "delete-address"
+	StepAddAddress         StepKind = "add-address"
+	StepSetLinkUp          StepKind = "set-link-up"
+	StepSetLinkDown        StepKind = "set-link-down"
+	StepSetMTU             StepKind = "set-mtu"
+	StepDeleteRoute        StepKind = "delete-route"
+	StepAddRoute           StepKind = "add-route"
+	StepWriteSysctl        StepKind = "write-sysctl"
+)
+
+// Step is a single change to the system.
+type Step struct {
+	Kind StepKind
+	// Interface is the name of the interface changed.
+	// This is blank for StepWriteSysctl.
+	Interface string `json:",omitempty"`
+	// Address is the address (for StepAddAddress and StepDeleteAddress) or route destination (for StepAddRoute and StepDeleteRoute).
+	Address *IPNet `json:",omitempty"`
+	// Table is the routing table of the route (for StepAddRoute and StepDeleteRoute), or 0 for the main table.
+	Table int `json:",omitempty"`
+	// MTU is the new MTU set by StepSetMTU.
+	MTU int `json:",omitempty"`
+	// Wireguard is the change made by StepConfigureWireguard.
+	Wireguard *WireguardChange `json:",omitempty"`
+	// Sysctl is the key of the sysctl written by StepWriteSysctl.
+	Sysctl   string `json:",omitempty"`
+	OldValue string `json:",omitempty"`
+	Value    string `json:",omitempty"`
+}
+
+func (s Step) String() string {
+	switch s.Kind {
+	case StepDeleteLink:
+		return fmt.Sprintf("- link %s", s.Interface)
+	case StepAddLink:
+		return fmt.Sprintf("+ link %s", s.Interface)
+	case StepConfigureWireguard:
+		b := new(strings.Builder)
+		fmt.Fprintf(b, "~ wireguard %s", s.Interface)
+		if s.Wireguard.PrivateKeyChanged {
+			b.WriteString("\n    ~ private key")
+		}
+		if s.Wireguard.ListenPort != nil {
+			fmt.Fprintf(b, "\n    ~ listen port %d", *s.Wireguard.ListenPort)
+		}
+		if s.Wireguard.FirewallMark != nil {
+			fmt.Fprintf(b, "\n    ~ fwmark %d", *s.Wireguard.FirewallMark)
+		}
+		for _, pc := range s.Wireguard.Peers {
+			b.WriteString("\n    ")
+			b.WriteString(pc.String())
+		}
+		return b.String()
+	case StepDeleteAddress:
+		return fmt.Sprintf("- address %s %s", s.Interface, (*net.IPNet)(s.Address))
+	case StepAddAddress:
+		return fmt.Sprintf("+ address %s %s", s.Interface, (*net.IPNet)(s.Address))
+	case StepSetLinkUp:
+		return fmt.Sprintf("~ link %s up", s.Interface)
+	case StepSetLinkDown:
+		return fmt.Sprintf("~ link %s down", s.Interface)
+	case StepSetMTU:
+		return fmt.Sprintf("~ link %s mtu %d", s.Interface, s.MTU)
+	case StepDeleteRoute:
+		return fmt.Sprintf("- route %s %s%s", s.Interface, (*net.IPNet)(s.Address), tableString(s.Table))
+	case StepAddRoute:
+		return fmt.Sprintf("+ route %s %s%s", s.Interface, (*net.IPNet)(s.Address), tableString(s.Table))
+	case StepWriteSysctl:
+		return fmt.Sprintf("~ sysctl %s %s → %s", s.Sysctl, s.OldValue, s.Value)
+	default:
+		return fmt.Sprintf("? %s", s.Kind)
+	}
+}
+
+func tableString(table int) string {
+	if table == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" table %d", table)
+}
+
+// WireguardChange is the change to a WireGuard interface's configuration.
+type WireguardChange struct {
+	PrivateKeyChanged bool `json:",omitempty"`
+	// ListenPort is the new listen port, if changed.
+	ListenPort *int `json:",omitempty"`
+	// FirewallMark is the new fwmark, if changed.
+	FirewallMark *int         `json:",omitempty"`
+	Peers        []PeerChange `json:",omitempty"`
+	config       wgtypes.Config
+}
+
+type PeerChangeKind string
+
+const (
+	PeerAdd    PeerChangeKind = "add"
+	PeerUpdate PeerChangeKind = "update"
+	PeerRemove PeerChangeKind = "remove"
+)
+
+// PeerChange is the change to a single peer of a WireGuard interface.
+type PeerChange struct {
+	Kind PeerChangeKind
+	// Name is the peer's name, or blank if the peer is not in the Machine (e.g. for removed peers).
+	Name      string `json:",omitempty"`
+	PublicKey Key
+	// Endpoint, PersistentKeepalive, and AllowedIPs are the peer's new configuration (for PeerAdd and PeerUpdate).
+	Endpoint            string   `json:",omitempty"`
+	PersistentKeepalive Duration `json:",omitempty"`
+	AllowedIPs          []IPNet  `json:",omitempty"`
+}
+
+func (pc PeerChange) String() string {
+	var sign string
+	switch pc.Kind {
+	case PeerAdd:
+		sign = "+"
+	case PeerUpdate:
+		sign = "~"
+	case PeerRemove:
+		sign = "-"
+	}
+	name := wgtypes.Key(pc.PublicKey).String()
+	if pc.Name != "" {
+		name = fmt.Sprintf("%s (%s)", pc.Name, name)
+	}
+	if pc.Kind == PeerRemove {
+		return fmt.Sprintf("%s peer %s", sign, name)
+	}
+	allowedIPs := make([]string, len(pc.AllowedIPs))
+	for i := range pc.AllowedIPs {
+		allowedIPs[i] = (*net.IPNet)(&pc.AllowedIPs[i]).String()
+	}
+	line := fmt.Sprintf("%s peer %s endpoint %q allowed-ips %s", sign, name, pc.Endpoint, strings.Join(allowedIPs, ","))
+	if pc.PersistentKeepalive != 0 {
+		line += fmt.Sprintf(" persistent-keepalive %s", time.Duration(pc.PersistentKeepalive))
+	}
+	return line
+}
+
+// Plan returns the steps needed to apply the given Machine to the system, without changing the system.
+// Use ApplyPlan to apply the returned plan.
+func (a *Applier) Plan(m Machine) (Plan, error) {
+	deviceNames, err := a.backend.WireguardDevices()
+	if err != nil {
+		return Plan{}, fmt.Errorf("getting wg devices: %w", err)
+	}
+	machineInterfaces := make([]string, len(m.Interfaces))
+	for i, iface := range m.Interfaces {
+		machineInterfaces[i] = iface.Name
+	}
+	owned, err := a.findOwnedInterfaces(deviceNames, machineInterfaces)
+	if err != nil {
+		return Plan{}, err
+	}
+	less := func(x, y string) bool { return x < y }
+	// interfaces not created by qrystal are never deleted
+	deletedInterfaces := setIntersection(setDifference(owned, append(slices.Clone(machineInterfaces), m.KeepInterfaces...), less), slices.Clone(deviceNames), less)
+	createdInterfaces := setDifference(slices.Clone(machineInterfaces), deviceNames, less)
+
+	var p Plan
+	for _, ifaceName := range deletedInterfaces {
+		p.Steps = append(p.Steps, Step{Kind: StepDeleteLink, Interface: ifaceName})
+	}
+	for _, ifaceName := range createdInterfaces {
+		if len(ifaceName) > MaxInterfaceNameLength {
+			return Plan{}, fmt.Errorf("adding interface %s: interface name too long (max %d)", ifaceName, MaxInterfaceNameLength)
+		}
+		p.Steps = append(p.Steps, Step{Kind: StepAddLink, Interface: ifaceName})
+	}
+	for _, iface := range m.Interfaces {
+		exists := !slices.Contains(createdInterfaces, iface.Name)
+		err = a.planInterface(&p, iface, exists)
+		if err != nil {
+			return Plan{}, fmt.Errorf("planning interface %s: %w", iface.Name, err)
+		}
+	}
+	if a.readWriteProc {
+		err = a.planForwarding(&p, sysctlForwardIPv4, m.ForwardsIPv4)
+		if err != nil {
+			return Plan{}, err
+		}
+		err = a.planForwarding(&p, sysctlForwardIPv6, m.ForwardsIPv6)
+		if err != nil {
+			return Plan{}, err
+		}
+	}
+	return p, nil
+}
+
+const (
+	sysctlForwardIPv4 = "net/ipv4/ip_forward"
+	sysctlForwardIPv6 = "net/ipv6/conf/all/forwarding"
+)
+
+// planForwarding plans setting the forwarding sysctl to 1 if needed.
+// If not needed, the sysctl is restored to its value before the Applier changed it (if it did), so forwarding enabled by someone else is kept.
+func (a *Applier) planForwarding(p *Plan, key string, needed bool) error {
+	original, changed := a.sysctlOriginals[key]
+	if !needed && !changed {
+		return nil
+	}
+	raw, err := a.backend.ReadSysctl(key)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+	newRaw := original
+	if needed {
+		newRaw = "1"
+	}
+	if raw != newRaw {
+		p.Steps = append(p.Steps, Step{Kind: StepWriteSysctl, Sysctl: key, OldValue: raw, Value: newRaw})
+	}
+	return nil
+}
+
+// planInterface plans updating the interface (which may not exist yet, if exists is false).
+func (a *Applier) planInterface(p *Plan, iface Interface, exists bool) error {
+	// Steps:
+	// - configure wg interface
+	// - remove/add addresses from wg interface
+	// - set MTU
+	// - set DNS[^1]
+	// - set up link (if applicable)
+	// - remove/add routes to wg interface
+	// [^1]: not implemented, maybe in future work
+
+	// === configure wg interface ===
+	current := new(wgtypes.Device)
+	var linkAddrs, routes []IPNet
+	up := false
+	mtu := 0
+	if exists {
+		var err error
+		current, err = a.backend.WireguardDevice(iface.Name)
+		if err != nil {
+			return fmt.Errorf("getting wg device: %w", err)
+		}
+		linkAddrs, err = a.backend.AddrList(iface.Name)
+		if err != nil {
+			return fmt.Errorf("listing addresses on wg interface: %w", err)
+		}
+		routes, err = a.backend.RouteList(iface.Name, iface.Table)
+		if err != nil {
+			return fmt.Errorf("listing routes on wg interface: %w", err)
+		}
+		up, err = a.backend.LinkUp(iface.Name)
+		if err != nil {
+			return fmt.Errorf("getting link state: %w", err)
+		}
+		mtu, err = a.backend.LinkMTU(iface.Name)
+		if err != nil {
+			return fmt.Errorf("getting link MTU: %w", err)
+		}
+	}
+	wc, err := planWireguard(iface, current)
+	if err != nil {
+		return err
+	}
+	if wc != nil {
+		p.Steps = append(p.Steps, Step{Kind: StepConfigureWireguard, Interface: iface.Name, Wireguard: wc})
+	}
+
+	// === remove/add addresses from wg interface ===
+	for _, ip := range setDifference(linkAddrs, slices.Clone(iface.Addresses), lessIPNet) {
+		p.Steps = append(p.Steps, Step{Kind: StepDeleteAddress, Interface: iface.Name, Address: &ip})
+	}
+	for _, ip := range setDifference(slices.Clone(iface.Addresses), linkAddrs, lessIPNet) {
+		p.Steps = append(p.Steps, Step{Kind: StepAddAddress, Interface: iface.Name, Address: &ip})
+	}
+
+	// === set MTU ===
+	if iface.MTU != 0 && iface.MTU != mtu {
+		p.Steps = append(p.Steps, Step{Kind: StepSetMTU, Interface: iface.Name, MTU: iface.MTU})
+	}
+
+	// === set up link ===
+	if !up {
+		p.Steps = append(p.Steps, Step{Kind: StepSetLinkUp, Interface: iface.Name})
+	}
+
+	// === remove/add routes to wg interface ===
+	if oldTable := a.routeTable(iface.Name); exists && oldTable != iface.Table {
+		// Table changed, so the routes in the previous table are not listed above
+		oldRoutes, err := a.backend.RouteList(iface.Name, oldTable)
+		if err != nil {
+			return fmt.Errorf("listing routes on wg interface in table %d: %w", oldTable, err)
+		}
+		for _, ip := range oldRoutes {
+			p.Steps = append(p.Steps, Step{Kind: StepDeleteRoute, Interface: iface.Name, Address: &ip, Table: oldTable})
+		}
+	}
+	ifaceRoutes := make([]IPNet, 0)
+	for _, peer := range iface.Peers {
+		ifaceRoutes = append(ifaceRoutes, peer.AllowedIPs...)
+	}
+	for _, ip := range setDifference(routes, slices.Clone(ifaceRoutes), lessIPNet) {
+		p.Steps = append(p.Steps, Step{Kind: StepDeleteRoute, Interface: iface.Name, Address: &ip, Table: iface.Table})
+	}
+	for _, ip := range setDifference(ifaceRoutes, routes, lessIPNet) {
+		p.Steps = append(p.Steps, Step{Kind: StepAddRoute, Interface: iface.Name, Address: &ip, Table: iface.Table})
+	}
+	return nil
+}
+
+// planWireguard returns the change needed to configure current into iface, or nil if there is no change.
+// Only changed peers are configured, so that unchanged peers keep their sessions (and traffic through them is not interrupted).
+func planWireguard(iface Interface, current *wgtypes.Device) (*WireguardChange, error) {
+	wc := new(WireguardChange)
+	if current.PrivateKey != wgtypes.Key(iface.PrivateKey) {
+		wc.PrivateKeyChanged = true
+		wc.config.PrivateKey = (*wgtypes.Key)(&iface.PrivateKey)
+	}
+	if iface.ListenPort != 0 && current.ListenPort != iface.ListenPort {
+		listenPort := iface.ListenPort
+		wc.ListenPort = &listenPort
+		wc.config.ListenPort = &listenPort
+	}
+	if current.FirewallMark != iface.FirewallMark {
+		firewallMark := iface.FirewallMark
+		wc.FirewallMark = &firewallMark
+		wc.config.FirewallMark = &firewallMark
+	}
+	for _, peer := range iface.Peers {
+		var endpoint *net.UDPAddr
+		if peer.Endpoint != "" {
+			var err error
+			endpoint, err = net.ResolveUDPAddr("udp", peer.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("resolving %s for peer %s: %w", peer.Endpoint, peer.Name, err)
+			}
+		}
+		pc := wgtypes.PeerConfig{
+			PublicKey:    wgtypes.Key(peer.PublicKey),
+			PresharedKey: (*wgtypes.Key)(peer.PresharedKey),
+			Endpoint:     endpoint,
+			// 0 disables persistent keepalive
+			PersistentKeepaliveInterval: (*time.Duration)(&peer.PersistentKeepalive),
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  ipNetUtilToStd(peer.AllowedIPs),
+		}
+		change := PeerChange{Name: peer.Name, PublicKey: peer.PublicKey, Endpoint: peer.Endpoint, PersistentKeepalive: peer.PersistentKeepalive, AllowedIPs: peer.AllowedIPs}
+		i := slices.IndexFunc(current.Peers, func(p wgtypes.Peer) bool { return p.PublicKey == pc.PublicKey })
+		if i == -1 {
+			change.Kind = PeerAdd
+		} else if !peerEqual(current.Peers[i], pc) {
+			change.Kind = PeerUpdate
+			pc.UpdateOnly = true
+			if pc.PresharedKey == nil && current.Peers[i].PresharedKey != (wgtypes.Key{}) {
+				// clear the preshared key
+				pc.PresharedKey = new(wgtypes.Key)
+			}
+		} else {
+			continue
+		}
+		wc.Peers = append(wc.Peers, change)
+		wc.config.Peers = append(wc.config.Peers, pc)
+	}
+	for _, peer := range current.Peers {
+		if !slices.ContainsFunc(iface.Peers, func(p InterfacePeer) bool { return wgtypes.Key(p.PublicKey) == peer.PublicKey }) {
+			wc.Peers = append(wc.Peers, PeerChange{Kind: PeerRemove, PublicKey: Key(peer.PublicKey)})
+			wc.config.Peers = append(wc.config.Peers, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+	if !wc.PrivateKeyChanged && wc.ListenPort == nil && wc.FirewallMark == nil && len(wc.Peers) == 0 {
+		return nil, nil
+	}
+	return wc, nil
+}
+
+// peerEqual returns whether applying pc to p would not change p.
+func peerEqual(p wgtypes.Peer, pc wgtypes.PeerConfig) bool {
+	if pc.PresharedKey != nil && *pc.PresharedKey != p.PresharedKey || pc.PresharedKey == nil && p.PresharedKey != (wgtypes.Key{}) {
+		return false
+	}
+	if pc.PersistentKeepaliveInterval != nil && *pc.PersistentKeepaliveInterval != p.PersistentKeepaliveInterval {
+		return false
+	}
+	// a blank endpoint means the peer's endpoint is learnt from its packets
+	if pc.Endpoint != nil && (p.Endpoint == nil || pc.Endpoint.String() != p.Endpoint.String()) {
+		return false
+	}
+	if len(p.AllowedIPs) != len(pc.AllowedIPs) {
+		return false
+	}
+	for _, ip := range pc.AllowedIPs {
+		if !slices.ContainsFunc(p.AllowedIPs, func(ip2 net.IPNet) bool { return ip.String() == ip2.String() }) {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyPlan applies the plan returned by Plan.
+// The system should not have been changed since the plan was made.
+// If a step fails, the steps already taken are undone, and an *ApplyError is returned.
+// The Applier's state is saved afterwards (see ApplierOptions.StatePath).
+func (a *Applier) ApplyPlan(p Plan) error {
+	prevOwnedInterfaces := slices.Clone(a.ownedInterfaces)
+	prevSysctlOriginals := maps.Clone(a.sysctlOriginals)
+	prevRouteTables := maps.Clone(a.routeTables)
+	var undo [][]Step
+	for _, step := range p.Steps {
+		inverse, err := a.invertStep(step)
+		if err != nil {
+			err = fmt.Errorf("snapshotting: %w", err)
+		} else {
+			err = a.applyStep(step)
+		}
+		if err != nil {
+			zap.S().Errorf("%s: %s; rolling back…", step, err)
+			rollbackErr := a.rollback(undo)
+			if rollbackErr == nil {
+				a.ownedInterfaces = prevOwnedInterfaces
+				a.sysctlOriginals = prevSysctlOriginals
+				a.routeTables = prevRouteTables
+				zap.S().Info("rolled back.")
+			} else {
+				// keep owning created interfaces that could not be removed, so a later apply removes them
+				zap.S().Errorf("rollback failed: %s", rollbackErr)
+			}
+			applyErr := &ApplyError{Step: step, Err: err, RollbackErr: rollbackErr}
+			if err := a.saveState(); err != nil {
+				return errors.Join(applyErr, fmt.Errorf("saving state: %w", err))
+			}
+			return applyErr
+		}
+		undo = append(undo, inverse)
+		a.recordStep(step)
+	}
+	err := a.saveState()
+	if err != nil {
+		return fmt.Errorf("saving state: %w", err)
+	}
+	return nil
+}
+
+// recordStep updates the Applier's state after the step is applied.
+func (a *Applier) recordStep(step Step) {
+	switch step.Kind {
+	case StepAddLink:
+		if !slices.Contains(a.ownedInterfaces, step.Interface) {
+			a.ownedInterfaces = append(a.ownedInterfaces, step.Interface)
+		}
+	case StepDeleteLink:
+		a.ownedInterfaces = slices.DeleteFunc(a.ownedInterfaces, func(name string) bool { return name == step.Interface })
+		delete(a.routeTables, step.Interface)
+	case StepAddRoute:
+		if a.routeTable(step.Interface) == step.Table {
+			return
+		}
+		if step.Table == 0 {
+			delete(a.routeTables, step.Interface)
+		} else {
+			if a.routeTables == nil {
+				a.routeTables = map[string]int{}
+			}
+			a.routeTables[step.Interface] = step.Table
+		}
+	case StepWriteSysctl:
+		a.recordSysctl(step)
+		return
+	default:
+		return
+	}
+	// save ownership (and route tables) right away, in case we crash before the end of the plan
+	err := a.saveState()
+	if err != nil {
+		zap.S().Warnf("saving state: %s", err)
+	}
+}
+
+// routeTable returns the routing table routes were last added to for the interface (0 for the main table).
+func (a *Applier) routeTable(name string) int {
+	return a.routeTables[name]
+}
+
+// findOwnedInterfaces returns the interfaces (of deviceNames) created by qrystal: the ones recorded as created, and the ones marked with OwnerAlias.
+// Interfaces in the machine are not checked for the marker, as they are not deleted anyway.
+func (a *Applier) findOwnedInterfaces(deviceNames, machineInterfaces []string) ([]string, error) {
+	owned := slices.Clone(a.ownedInterfaces)
+	for _, name := range deviceNames {
+		if slices.Contains(owned, name) || slices.Contains(machineInterfaces, name) {
+			continue
+		}
+		alias, err := a.backend.LinkAlias(name)
+		if errors.Is(err, ErrLinkNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("getting alias of %s: %w", name, err)
+		}
+		if alias == OwnerAlias {
+			owned = append(owned, name)
+		}
+	}
+	return owned, nil
+}
+
+// recordSysctl keeps the value of the sysctl before it was first changed, so it can be restored later.
+func (a *Applier) recordSysctl(step Step) {
+	original, ok := a.sysctlOriginals[step.Sysctl]
+	switch {
+	case !ok:
+		if a.sysctlOriginals == nil {
+			a.sysctlOriginals = map[string]string{}
+		}
+		a.sysctlOriginals[step.Sysctl] = step.OldValue
+	case step.Value == original:
+		// restored
+		delete(a.sysctlOriginals, step.Sysctl)
+	}
+}
+
+func (a *Applier) applyStep(step Step) error {
+	switch step.Kind {
+	case StepDeleteLink:
+		return a.backend.DeleteLink(step.Interface)
+	case StepAddLink:
+		err := a.backend.AddLink(step.Interface)
+		if err != nil {
+			return err
+		}
+		// mark the link as created by qrystal, so it can be found even without the state
+		err = a.backend.SetLinkAlias(step.Interface, OwnerAlias)
+		if err != nil {
+			if err2 := a.backend.DeleteLink(step.Interface); err2 != nil {
+				return errors.Join(fmt.Errorf("setting alias: %w", err), fmt.Errorf("deleting link: %w", err2))
+			}
+			return fmt.Errorf("setting alias: %w", err)
+		}
+		return nil
+	case StepConfigureWireguard:
+		zap.S().Debugf("wg interface configuration:\n%s", StringConfig(&step.Wireguard.config))
+		return a.backend.ConfigureWireguard(step.Interface, step.Wireguard.config)
+	case StepDeleteAddress:
+		return a.backend.AddrDel(step.Interface, *step.Address)
+	case StepAddAddress:
+		return a.backend.AddrAdd(step.Interface, *step.Address)
+	case StepSetLinkUp:
+		return a.backend.SetLinkUp(step.Interface)
+	case StepSetLinkDown:
+		return a.backend.SetLinkDown(step.Interface)
+	case StepSetMTU:
+		return a.backend.SetLinkMTU(step.Interface, step.MTU)
+	case StepDeleteRoute:
+		return a.backend.RouteDel(step.Interface, *step.Address, step.Table)
+	case StepAddRoute:
+		return a.backend.RouteAdd(step.Interface, *step.Address, step.Table)
+	case StepWriteSysctl:
+		return a.backend.WriteSysctl(step.Sysctl, step.Value)
+	default:
+		return fmt.Errorf("unknown step kind %s", step.Kind)
+	}
+}
@@ -0,0 +1,216 @@
+package goal
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestPlan(t *testing.T) {
+	backend := new(FakeBackend)
+	backend.SetSysctl("net/ipv4/ip_forward", "0")
+	a, err := NewApplier(ApplierOptions{Backend: backend, Linux: ApplierOptionsLinux{ReadWriteProc: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Machine{
+		Interfaces: []Interface{{
+			Name:       "qrystal0",
+			PrivateKey: mustKey(t),
+			Addresses:  []IPNet{mustIPNet(t, "10.10.0.1/32")},
+			Peers: []InterfacePeer{{
+				Name:       "b",
+				PublicKey:  Key(wgtypes.Key(mustKey(t)).PublicKey()),
+				AllowedIPs: []IPNet{mustIPNet(t, "10.10.0.2/32")},
+			}},
+		}},
+		ForwardsIPv4: true,
+	}
+	p, err := a.Plan(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make([]StepKind, len(p.Steps))
+	for i, step := range p.Steps {
+		kinds[i] = step.Kind
+	}
+	expected := []StepKind{StepAddLink, StepConfigureWireguard, StepAddAddress, StepSetLinkUp, StepAddRoute, StepWriteSysctl}
+	if len(kinds) != len(expected) {
+		t.Fatalf("got steps %v, expected %v", kinds, expected)
+	}
+	for i := range kinds {
+		if kinds[i] != expected[i] {
+			t.Fatalf("got steps %v, expected %v", kinds, expected)
+		}
+	}
+	if len(p.Steps[1].Wireguard.Peers) != 1 || p.Steps[1].Wireguard.Peers[0].Kind != PeerAdd {
+		t.Fatalf("unexpected peer changes: %v", p.Steps[1].Wireguard.Peers)
+	}
+	if _, err := json.Marshal(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// planning must not change the system
+	if _, ok := backend.Link("qrystal0"); ok {
+		t.Fatal("Plan created interface")
+	}
+	if value, _ := backend.Sysctl("net/ipv4/ip_forward"); value != "0" {
+		t.Fatalf("Plan wrote ip_forward: %s", value)
+	}
+
+	err = a.ApplyPlan(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = a.Plan(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Empty() {
+		t.Fatalf("expected no changes after applying, got:\n%s", p)
+	}
+}
+
+func TestPlanIncrementalPeers(t *testing.T) {
+	backend := new(FakeBackend)
+	a, err := NewApplier(ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := func(name, allowedIP string) InterfacePeer {
+		return InterfacePeer{
+			Name:       name,
+			PublicKey:  Key(wgtypes.Key(mustKey(t)).PublicKey()),
+			AllowedIPs: []IPNet{mustIPNet(t, allowedIP)},
+		}
+	}
+	b, c, d := peer("b", "10.10.0.2/32"), peer("c", "10.10.0.3/32"), peer("d", "10.10.0.4/32")
+	m := Machine{Interfaces: []Interface{{Name: "qrystal0", PrivateKey: mustKey(t), Peers: []InterfacePeer{b, c}}}}
+	err = a.ApplyMachine(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep b, change c, add d
+	c.AllowedIPs = []IPNet{mustIPNet(t, "10.10.0.5/32")}
+	m.Interfaces[0].Peers = []InterfacePeer{b, c, d}
+	p, err := a.Plan(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Steps[0].Kind != StepConfigureWireguard {
+		t.Fatalf("unexpected plan:\n%s", p)
+	}
+	wc := p.Steps[0].Wireguard
+	if wc.PrivateKeyChanged || wc.config.PrivateKey != nil || wc.config.ReplacePeers {
+		t.Fatalf("unexpected change: %#v", wc.config)
+	}
+	if len(wc.config.Peers) != 2 || wc.config.Peers[0].PublicKey != wgtypes.Key(c.PublicKey) || !wc.config.Peers[0].UpdateOnly || wc.config.Peers[1].PublicKey != wgtypes.Key(d.PublicKey) {
+		t.Fatalf("unexpected peer changes:\n%s", p)
+	}
+	err = a.ApplyPlan(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remove b
+	m.Interfaces[0].Peers = []InterfacePeer{c, d}
+	p, err = a.Plan(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc = p.Steps[0].Wireguard
+	if len(wc.config.Peers) != 1 || wc.config.Peers[0].PublicKey != wgtypes.Key(b.PublicKey) || !wc.config.Peers[0].Remove {
+		t.Fatalf("unexpected peer changes:\n%s", p)
+	}
+	err = a.ApplyPlan(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, _ := backend.Link("qrystal0")
+	if len(link.Device.Peers) != 2 {
+		t.Fatalf("unexpected peers: %v", link.Device.Peers)
+	}
+}
+
+func TestApplyLinkOptions(t *testing.T) {
+	backend := new(FakeBackend)
+	a, err := NewApplier(ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Machine{Interfaces: []Interface{{
+		Name:         "qrystal0",
+		PrivateKey:   mustKey(t),
+		MTU:          1280,
+		FirewallMark: 51820,
+		Table:        100,
+		Peers: []InterfacePeer{{
+			Name:                "b",
+			PublicKey:           Key(wgtypes.Key(mustKey(t)).PublicKey()),
+			PersistentKeepalive: Duration(25 * time.Second),
+			AllowedIPs:          []IPNet{mustIPNet(t, "10.10.0.2/32")},
+		}},
+	}}}
+	err = a.ApplyMachine(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, _ := backend.Link("qrystal0")
+	if link.MTU != 1280 || link.Device.FirewallMark != 51820 {
+		t.Fatalf("unexpected MTU %d or fwmark %d", link.MTU, link.Device.FirewallMark)
+	}
+	if len(link.Device.Peers) != 1 || link.Device.Peers[0].PersistentKeepaliveInterval != 25*time.Second {
+		t.Fatalf("unexpected peers: %#v", link.Device.Peers)
+	}
+	if len(link.Routes) != 0 || len(link.TableRoutes[100]) != 1 {
+		t.Fatalf("unexpected routes: main %v, table 100 %v", link.Routes, link.TableRoutes[100])
+	}
+	p, err := a.Plan(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Empty() {
+		t.Fatalf("expected no changes after applying, got:\n%s", p)
+	}
+	drifts, err := a.Drift(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("unexpected drift: %v", drifts)
+	}
+
+	// routes move to the new table
+	m.Interfaces[0].Table = 200
+	err = a.ApplyMachine(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, _ = backend.Link("qrystal0")
+	if len(link.Routes) != 0 || len(link.TableRoutes[100]) != 0 || len(link.TableRoutes[200]) != 1 {
+		t.Fatalf("unexpected routes: main %v, table 100 %v, table 200 %v", link.Routes, link.TableRoutes[100], link.TableRoutes[200])
+	}
+
+	// routes in the table in use are restored on rollback
+	injected := errors.New("injected")
+	backend.FailOn("AddLink", injected)
+	err = a.ApplyMachine(Machine{Interfaces: []Interface{{Name: "qrystal1", PrivateKey: mustKey(t)}}})
+	if !errors.Is(err, injected) {
+		t.Fatalf("expected injected error, got %v", err)
+	}
+	link, ok := backend.Link("qrystal0")
+	if !ok || len(link.TableRoutes[200]) != 1 {
+		t.Fatalf("routes not restored: %#v", link)
+	}
+	p, err = a.Plan(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Empty() {
+		t.Fatalf("expected no changes after rolling back, got:\n%s", p)
+	}
+}
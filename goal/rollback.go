@@ -0,0 +1,152 @@
+package goal
+
+import (
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ApplyError is returned by ApplyPlan (and ApplyMachine) when a step fails.
+type ApplyError struct {
+	// Step is the step that failed.
+	Step Step
+	Err  error
+	// RollbackErr is the error encountered while undoing the steps taken before Step, or nil if all of them were undone.
+	RollbackErr error
+}
+
+func (e *ApplyError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%s: %s (rollback failed, system may be inconsistent: %s)", e.Step, e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("%s: %s (rolled back)", e.Step, e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// invertStep returns the steps that undo step, given the current state of the system (i.e. before step is applied).
+func (a *Applier) invertStep(step Step) ([]Step, error) {
+	switch step.Kind {
+	case StepDeleteLink:
+		return a.snapshotLink(step.Interface)
+	case StepAddLink:
+		return []Step{{Kind: StepDeleteLink, Interface: step.Interface}}, nil
+	case StepConfigureWireguard:
+		device, err := a.backend.WireguardDevice(step.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("getting wg device: %w", err)
+		}
+		return []Step{configureWireguardStep(step.Interface, device)}, nil
+	case StepDeleteAddress:
+		return []Step{{Kind: StepAddAddress, Interface: step.Interface, Address: step.Address}}, nil
+	case StepAddAddress:
+		return []Step{{Kind: StepDeleteAddress, Interface: step.Interface, Address: step.Address}}, nil
+	case StepSetLinkUp:
+		return []Step{{Kind: StepSetLinkDown, Interface: step.Interface}}, nil
+	case StepSetLinkDown:
+		return []Step{{Kind: StepSetLinkUp, Interface: step.Interface}}, nil
+	case StepSetMTU:
+		mtu, err := a.backend.LinkMTU(step.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("getting link MTU: %w", err)
+		}
+		return []Step{{Kind: StepSetMTU, Interface: step.Interface, MTU: mtu}}, nil
+	case StepDeleteRoute:
+		return []Step{{Kind: StepAddRoute, Interface: step.Interface, Address: step.Address, Table: step.Table}}, nil
+	case StepAddRoute:
+		return []Step{{Kind: StepDeleteRoute, Interface: step.Interface, Address: step.Address, Table: step.Table}}, nil
+	case StepWriteSysctl:
+		return []Step{{Kind: StepWriteSysctl, Sysctl: step.Sysctl, OldValue: step.Value, Value: step.OldValue}}, nil
+	default:
+		return nil, fmt.Errorf("unknown step kind %s", step.Kind)
+	}
+}
+
+// snapshotLink returns the steps that recreate the link in its current state.
+// Only routes in the routing table in use (see Applier.routeTables) are recreated.
+func (a *Applier) snapshotLink(name string) ([]Step, error) {
+	device, err := a.backend.WireguardDevice(name)
+	if err != nil {
+		return nil, fmt.Errorf("getting wg device: %w", err)
+	}
+	addrs, err := a.backend.AddrList(name)
+	if err != nil {
+		return nil, fmt.Errorf("listing addresses: %w", err)
+	}
+	table := a.routeTable(name)
+	routes, err := a.backend.RouteList(name, table)
+	if err != nil {
+		return nil, fmt.Errorf("listing routes: %w", err)
+	}
+	up, err := a.backend.LinkUp(name)
+	if err != nil {
+		return nil, fmt.Errorf("getting link state: %w", err)
+	}
+	mtu, err := a.backend.LinkMTU(name)
+	if err != nil {
+		return nil, fmt.Errorf("getting link MTU: %w", err)
+	}
+	steps := []Step{
+		{Kind: StepAddLink, Interface: name},
+		configureWireguardStep(name, device),
+		{Kind: StepSetMTU, Interface: name, MTU: mtu},
+	}
+	for _, addr := range addrs {
+		steps = append(steps, Step{Kind: StepAddAddress, Interface: name, Address: &addr})
+	}
+	if up {
+		steps = append(steps, Step{Kind: StepSetLinkUp, Interface: name})
+	}
+	for _, route := range routes {
+		steps = append(steps, Step{Kind: StepAddRoute, Interface: name, Address: &route, Table: table})
+	}
+	return steps, nil
+}
+
+// configureWireguardStep returns the step that configures the WireGuard link to be exactly like device.
+func configureWireguardStep(name string, device *wgtypes.Device) Step {
+	peers := make([]wgtypes.PeerConfig, len(device.Peers))
+	for i, peer := range device.Peers {
+		peers[i] = wgtypes.PeerConfig{
+			PublicKey:                   peer.PublicKey,
+			PresharedKey:                &peer.PresharedKey,
+			Endpoint:                    peer.Endpoint,
+			PersistentKeepaliveInterval: &peer.PersistentKeepaliveInterval,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  peer.AllowedIPs,
+		}
+	}
+	return Step{
+		Kind:      StepConfigureWireguard,
+		Interface: name,
+		Wireguard: &WireguardChange{
+			config: wgtypes.Config{
+				PrivateKey:   &device.PrivateKey,
+				ListenPort:   &device.ListenPort,
+				FirewallMark: &device.FirewallMark,
+				ReplacePeers: true,
+				Peers:        peers,
+			},
+		},
+	}
+}
+
+// rollback applies undo in reverse order.
+// Failed steps are skipped (after all, the rest may still succeed), and all errors are returned together.
+func (a *Applier) rollback(undo [][]Step) error {
+	var errs []error
+	for i := len(undo) - 1; i >= 0; i-- {
+		for _, step := range undo[i] {
+			zap.S().Debugf("rollback: %s", step)
+			err := a.applyStep(step)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", step, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
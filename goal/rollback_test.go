@@ -0,0 +1,90 @@
+package goal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestApplyMachineRollback(t *testing.T) {
+	backend := new(FakeBackend)
+	backend.SetSysctl("net/ipv4/ip_forward", "0")
+	a, err := NewApplier(ApplierOptions{Backend: backend, Linux: ApplierOptionsLinux{ReadWriteProc: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := func(name, allowedIP string) InterfacePeer {
+		return InterfacePeer{
+			Name:       name,
+			PublicKey:  Key(wgtypes.Key(mustKey(t)).PublicKey()),
+			Endpoint:   "127.0.0.1:51820",
+			AllowedIPs: []IPNet{mustIPNet(t, allowedIP)},
+		}
+	}
+	m := Machine{
+		Interfaces: []Interface{{
+			Name:       "qrystal0",
+			PrivateKey: mustKey(t),
+			ListenPort: 51820,
+			Addresses:  []IPNet{mustIPNet(t, "10.10.0.1/32")},
+			Peers:      []InterfacePeer{peer("b", "10.10.0.2/32")},
+		}},
+	}
+	err = a.ApplyMachine(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := backend.Link("qrystal0")
+
+	// every step but the last (adding a route) succeeds
+	m2 := Machine{
+		Interfaces: []Interface{{
+			Name:       "qrystal0",
+			PrivateKey: mustKey(t),
+			ListenPort: 51821,
+			Addresses:  []IPNet{mustIPNet(t, "10.10.0.3/32")},
+			Peers:      []InterfacePeer{peer("c", "10.10.0.4/32")},
+		}, {
+			Name:       "qrystal1",
+			PrivateKey: mustKey(t),
+			Addresses:  []IPNet{mustIPNet(t, "10.11.0.1/32")},
+		}},
+		ForwardsIPv4: true,
+	}
+	injected := errors.New("injected")
+	backend.FailOn("RouteAdd", injected)
+	err = a.ApplyMachine(m2)
+	var applyErr *ApplyError
+	if !errors.As(err, &applyErr) {
+		t.Fatalf("expected ApplyError, got %v", err)
+	}
+	if !errors.Is(err, injected) || applyErr.Step.Kind != StepAddRoute {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if applyErr.RollbackErr != nil {
+		t.Fatalf("rollback failed: %s", applyErr.RollbackErr)
+	}
+	after, _ := backend.Link("qrystal0")
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("not rolled back:\nbefore %#v\nafter  %#v", before, after)
+	}
+	if _, ok := backend.Link("qrystal1"); ok {
+		t.Fatal("created interface not removed")
+	}
+	if value, _ := backend.Sysctl("net/ipv4/ip_forward"); value != "0" {
+		t.Fatalf("ip_forward not restored: %s", value)
+	}
+
+	// rollback failures are reported
+	backend.FailOn("WriteSysctl", injected)
+	backend.FailOn("DeleteLink", injected)
+	err = a.ApplyMachine(m2)
+	if !errors.As(err, &applyErr) || applyErr.Step.Kind != StepWriteSysctl {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(applyErr.RollbackErr, injected) {
+		t.Fatalf("expected rollback error, got %v", applyErr.RollbackErr)
+	}
+}
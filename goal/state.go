@@ -0,0 +1,70 @@
+package goal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+
+	"github.com/nyiyui/qrystal/util"
+	"go.uber.org/zap"
+)
+
+// ApplierState is the part of an Applier that is persisted (see ApplierOptions.StatePath), so that a later run can undo changes made by an earlier one.
+type ApplierState struct {
+	// OwnedInterfaces are the interfaces created by the Applier (and removed when they are not in a Machine anymore).
+	OwnedInterfaces []string
+	// SysctlOriginals are the values of sysctls before the Applier changed them.
+	SysctlOriginals map[string]string
+	// RouteTables is the routing table routes were last added to for each interface, if not the main table.
+	RouteTables map[string]int `json:",omitempty"`
+}
+
+func (a *Applier) loadState() error {
+	data, err := os.ReadFile(a.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state ApplierState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", a.statePath, err)
+	}
+	for _, name := range state.OwnedInterfaces {
+		if !slices.Contains(a.ownedInterfaces, name) {
+			a.ownedInterfaces = append(a.ownedInterfaces, name)
+		}
+	}
+	a.sysctlOriginals = state.SysctlOriginals
+	a.routeTables = state.RouteTables
+	zap.S().Debugf("loaded state: owning %v.", a.ownedInterfaces)
+	return nil
+}
+
+// saveState saves the state if a state path is set.
+func (a *Applier) saveState() error {
+	if a.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(ApplierState{
+		OwnedInterfaces: a.ownedInterfaces,
+		SysctlOriginals: a.sysctlOriginals,
+		RouteTables:     a.routeTables,
+	})
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(a.statePath, data, 0600)
+}
+
+// Teardown removes all interfaces created by the Applier, and restores the sysctls it changed.
+// Existing interfaces used by a Machine are left as they are.
+func (a *Applier) Teardown() error {
+	zap.S().Infof("tearing down %v…", a.ownedInterfaces)
+	return a.ApplyMachine(Machine{})
+}
@@ -0,0 +1,111 @@
+package goal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStateTeardown(t *testing.T) {
+	backend := new(FakeBackend)
+	backend.SetSysctl("net/ipv4/ip_forward", "0")
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	opt := ApplierOptions{Backend: backend, StatePath: statePath, Linux: ApplierOptionsLinux{ReadWriteProc: true}}
+	a, err := NewApplier(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ApplyMachine(Machine{
+		Interfaces:   []Interface{{Name: "qrystal0", PrivateKey: mustKey(t)}, {Name: "qrystal1", PrivateKey: mustKey(t)}},
+		ForwardsIPv4: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.AddLink("other0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a later run (e.g. after a crash) knows what the earlier one changed
+	a2, err := NewApplier(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a2.ApplyMachine(Machine{
+		Interfaces:   []Interface{{Name: "qrystal0", PrivateKey: mustKey(t)}},
+		ForwardsIPv4: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Link("qrystal1"); ok {
+		t.Fatal("leftover interface not removed")
+	}
+
+	a3, err := NewApplier(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a3.Teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Link("qrystal0"); ok {
+		t.Fatal("interface not torn down")
+	}
+	if _, ok := backend.Link("other0"); !ok {
+		t.Fatal("unmanaged interface removed")
+	}
+	if value, _ := backend.Sysctl("net/ipv4/ip_forward"); value != "0" {
+		t.Fatalf("ip_forward not restored: %s", value)
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	backend := new(FakeBackend)
+	a, err := NewApplier(ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an interface created by the user, then used by a machine
+	err = backend.AddLink("user0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ApplyMachine(Machine{Interfaces: []Interface{
+		{Name: "user0", PrivateKey: mustKey(t)},
+		{Name: "qrystal0", PrivateKey: mustKey(t)},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, _ := backend.Link("qrystal0"); link.Alias != OwnerAlias {
+		t.Fatalf("created interface not marked: alias %q", link.Alias)
+	}
+	if link, _ := backend.Link("user0"); link.Alias != "" {
+		t.Fatalf("existing interface marked: alias %q", link.Alias)
+	}
+
+	// without a state file, a new Applier finds its interfaces by their alias
+	a2, err := NewApplier(ApplierOptions{Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a2.ApplyMachine(Machine{KeepInterfaces: []string{"qrystal0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Link("qrystal0"); !ok {
+		t.Fatal("kept interface removed")
+	}
+	err = a2.ApplyMachine(Machine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.Link("qrystal0"); ok {
+		t.Fatal("stale created interface not removed")
+	}
+	if _, ok := backend.Link("user0"); !ok {
+		t.Fatal("interface created by the user removed")
+	}
+}
@@ -30,23 +30,54 @@ args@{
           default = [ ];
         };
       };
+      linkOptions = {
+        MTU = mkOption {
+          type = ints.unsigned;
+          default = 0;
+          description = "MTU of the WireGuard interface. Set to 0 to leave as is.";
+        };
+        FirewallMark = mkOption {
+          type = ints.u32;
+          default = 0;
+          description = "fwmark set on packets sent by WireGuard. Set to 0 for none.";
+        };
+        Table = mkOption {
+          type = ints.u32;
+          default = 0;
+          description = "Routing table to add routes to peers to. Set to 0 for the main table.";
+        };
+      };
       networkType = submodule {
         options.Name = mkOption { type = networkName; };
         options.Devices = mkOption {
           type = listOf deviceType;
           default = [ ];
         };
+        options.AddressRanges = mkOption {
+          type = listOf str;
+          default = [ ];
+          description = "IP networks (IPv4 and/or IPv6) to allocate addresses from for devices without Addresses.";
+        };
+        options.MaxForwardingHops = mkOption {
+          type = ints.unsigned;
+          default = 0;
+          description = "Maximum number of forwarders packets to a device can pass through. Set to 0 for the default (3).";
+        };
+        options.MTU = linkOptions.MTU;
+        options.FirewallMark = linkOptions.FirewallMark;
+        options.Table = linkOptions.Table;
       };
       deviceTypeRaw = submodule {
         options.Name = mkOption { type = str; };
         options.Endpoints = mkOption {
-          type = listOf str;
+          type = listOf (either str attrs);
           default = [ ];
-          description = "Unordered list of endpoints on which the peer is available on. Leave blank if the peer is not accessible from any other peer (e.g. behind a NAT).";
+          description = "List of endpoints on which the peer is available on: either \"host:port\" strings, or attrsets with Address, Priority, Label, and SourceNetworks (see Choosing Endpoints in TUTORIAL.md). Leave blank if the peer is not accessible from any other peer (e.g. behind a NAT).";
         };
         options.Addresses = mkOption {
-          type = addCheck (listOf str) (l: (builtins.length l) > 0);
-          description = "List of IP networks that this peer represents.";
+          type = listOf str;
+          default = [ ];
+          description = "List of IP networks that this peer represents. Leave empty to allocate from the network's AddressRanges.";
         };
         options.ListenPort = mkOption {
           type = port;
@@ -83,6 +114,10 @@ args@{
           default = [ ];
           description = "List of devices this device can access.";
         };
+        # overrides the network's options if not 0
+        options.MTU = linkOptions.MTU;
+        options.FirewallMark = linkOptions.FirewallMark;
+        options.Table = linkOptions.Table;
       };
       deviceType = addCheck deviceTypeRaw (d: (d.AccessAll == true) != ((length d.AccessControl) > 0));
       clientConfig = submodule {
@@ -91,8 +126,13 @@ args@{
           description = "Qrystal coordination server base URL.";
         };
         options.TokenPath = mkOption {
-          type = path;
-          description = "Token to use with coordination server.";
+          type = str;
+          description = "Token to use with coordination server. If EnrollTokenPath is set, the issued token is written here.";
+        };
+        options.EnrollTokenPath = mkOption {
+          type = nullOr path;
+          default = null;
+          description = "One-time enrollment token to add this device to the network with, if TokenPath does not exist yet.";
         };
         options.Network = mkOption { type = networkName; };
         options.Device = mkOption { type = str; };
@@ -106,6 +146,11 @@ args@{
           default = "2m";
           description = "minimum interval to poll for updates to coordination server.";
         };
+        options.LongPollWait = mkOption {
+          type = str;
+          default = "5m";
+          description = "how long the coordination server waits for a spec change before responding to a poll. Set to 0s to disable long-polling.";
+        };
         options.CertPath = mkOption {
           type = nullOr path;
           default = null;
@@ -170,11 +215,60 @@ args@{
                 type = attrsOf (submodule {
                   options.Identities = mkOption {
                     type = listOf (addCheck (listOf str) (l: (length l) == 2));
+                    default = [ ];
                     description = "The devices that this token can identify as (i.e. perform actions as). Tuple with two values, network and then device.";
                   };
+                  options.Scopes = mkOption {
+                    type = listOf (enum [
+                      "reify:read"
+                      "reify:patch"
+                      "admin"
+                    ]);
+                    default = [ ];
+                    description = "What this token is allowed to do. reify:read allows getting the spec, reify:patch allows changing e.g. the public key, and admin allows using the admin API. Leave empty for reify:read and reify:patch.";
+                  };
+                  options.NotBefore = mkOption {
+                    type = nullOr str;
+                    default = null;
+                    description = "RFC 3339 time from which this token is valid.";
+                  };
+                  options.NotAfter = mkOption {
+                    type = nullOr str;
+                    default = null;
+                    description = "RFC 3339 time until which this token is valid.";
+                  };
+                  options.Enroll = mkOption {
+                    type = nullOr (submodule {
+                      options.Network = mkOption { type = networkName; };
+                      options.AddressPools = mkOption {
+                        type = listOf str;
+                        description = "CIDRs to allocate addresses for the enrolled device from.";
+                      };
+                      options.AccessControl = mkOption {
+                        type = attrs;
+                        default = { AccessAll = true; };
+                        description = "AccessControl of the enrolled device.";
+                      };
+                      options.Scopes = mkOption {
+                        type = listOf (enum [
+                          "reify:read"
+                          "reify:patch"
+                        ]);
+                        default = [ ];
+                        description = "Scopes of the token issued to the enrolled device.";
+                      };
+                    });
+                    default = null;
+                    description = "Makes this a one-time enrollment token which adds a device to Network. Requires StorePath.";
+                  };
                 });
                 description = "token hashes and their authorized actions.";
               };
+              StorePath = mkOption {
+                type = nullOr str;
+                default = "/var/lib/qrystal-coord-server/state.json";
+                description = "File to persist the spec (including changes made by devices) in. Set to null to keep the spec in memory only.";
+              };
             };
           };
         };
@@ -198,6 +292,45 @@ args@{
                 default = true;
                 description = "Instead of writing to procfs to change options, assume they are already set and do not write to procfs.";
               };
+              DriftCheckInterval = mkOption {
+                type = str;
+                default = "1m";
+                description = "How often to check whether the WireGuard interfaces were changed by something else (and undo the changes). Set to 0s to disable.";
+              };
+              FailoverCheckInterval = mkOption {
+                type = str;
+                default = "30s";
+                description = "How often to check the handshakes of peers, and choose another endpoint (or a forwarder) for unreachable peers. Set to 0s to disable.";
+              };
+              StatePath = mkOption {
+                type = str;
+                default = "/var/lib/qrystal-device-client/state.json";
+                description = "File to record the interfaces and sysctls changed in, so that they can be cleaned up by a later run.";
+              };
+              EndpointScorer = mkOption {
+                type = attrs;
+                default = {
+                  Kind = "ping";
+                };
+                description = "How to score the endpoints of peers (see Choosing Endpoints in TUTORIAL.md).";
+              };
+              ForwarderPolicy = mkOption {
+                type = enum [
+                  "hash"
+                  "least-loaded"
+                  "latency"
+                ];
+                default = "hash";
+                description = "How to choose a forwarder for peers without a working endpoint (see Choosing Endpoints in TUTORIAL.md).";
+              };
+              ShutdownPolicy = mkOption {
+                type = enum [
+                  "leave"
+                  "teardown"
+                ];
+                default = "leave";
+                description = "What to do with the WireGuard interfaces when the device client stops: leave them as they are, or tear them down.";
+              };
               dns = mkOption {
                 type = submodule {
                   options.enable = mkEnableOption "Qrystal on-device DNS server.";
@@ -241,7 +374,9 @@ args@{
               serviceConfig = {
                 Type = "notify";
                 NotifyAccess = "all";
+                ExecReload = "${pkgs.coreutils}/bin/kill -HUP $MAINPID";
                 DynamicUser = true;
+                StateDirectory = [ "qrystal-coord-server" ];
               } // baseServiceConfig;
               wantedBy = [ "multi-user.target" ];
             };
@@ -0,0 +1,122 @@
+package spec
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/nyiyui/qrystal/goal"
+	"github.com/nyiyui/qrystal/util"
+)
+
+// AllocateAddresses returns a host address (/32 or /128) from each of ranges that is not used by any device in n.
+// The network address of each range (e.g. 10.10.0.0 for 10.10.0.0/24) is never allocated, and neither is the broadcast address of IPv4 ranges larger than /31 (e.g. 10.10.0.255).
+func (n Network) AllocateAddresses(ranges []goal.IPNet) ([]goal.IPNet, error) {
+	var used []net.IPNet
+	for _, nd := range n.Devices {
+		for _, addr := range nd.Addresses {
+			used = append(used, net.IPNet(addr))
+		}
+	}
+	addresses := make([]goal.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		r := net.IPNet{IP: r.IP.Mask(r.Mask), Mask: r.Mask}
+		reserved := []net.IPNet{{IP: r.IP, Mask: hostMask(r.IP)}}
+		if broadcast, ok := broadcastAddress(r); ok {
+			reserved = append(reserved, net.IPNet{IP: broadcast, Mask: hostMask(broadcast)})
+		}
+		ip, err := util.AssignAddress(&r, append(used, reserved...))
+		if err != nil {
+			return nil, fmt.Errorf("range %s: %w", &r, err)
+		}
+		address := net.IPNet{IP: ip, Mask: hostMask(ip)}
+		used = append(used, address)
+		addresses = append(addresses, goal.IPNet(address))
+	}
+	return addresses, nil
+}
+
+// AssignAddresses allocates addresses from AddressRanges to devices without Addresses.
+// Devices that already have Addresses are not changed, so assignments are stable as long as they are kept (e.g. in a store).
+func (n *Network) AssignAddresses() error {
+	if len(n.AddressRanges) == 0 {
+		return nil
+	}
+	for i := range n.Devices {
+		nd := &n.Devices[i]
+		if len(nd.Addresses) != 0 {
+			continue
+		}
+		addresses, err := n.AllocateAddresses(n.AddressRanges)
+		if err != nil {
+			return fmt.Errorf("network %s: device %s: %w", n.Name, nd.Name, err)
+		}
+		nd.Addresses = addresses
+	}
+	return nil
+}
+
+// validateAddresses checks that no address is used by more than one device, and that all addresses are inside AddressRanges (if set).
+func (n Network) validateAddresses(v *validator, prefix string) {
+	for i, nd := range n.Devices {
+		for j, addr_ := range nd.Addresses {
+			addr := net.IPNet(addr_)
+			path := fmt.Sprintf("%sDevices[%d].Addresses[%d]", prefix, i, j)
+			if len(n.AddressRanges) != 0 && !n.inRanges(addr) {
+				v.addf(path, "%s is outside of AddressRanges", &addr)
+			}
+			for k, nd2 := range n.Devices[i+1:] {
+				for l, addr2_ := range nd2.Addresses {
+					addr2 := net.IPNet(addr2_)
+					if addr.Contains(addr2.IP) || addr2.Contains(addr.IP) {
+						v.addf(path, "%s overlaps with %s of device %s (%sDevices[%d].Addresses[%d])", &addr, &addr2, nd2.Name, prefix, i+1+k, l)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (n Network) inRanges(addr net.IPNet) bool {
+	addrOnes, addrBits := addr.Mask.Size()
+	for _, r_ := range n.AddressRanges {
+		r := net.IPNet(r_)
+		ones, bits := r.Mask.Size()
+		if bits == addrBits && ones <= addrOnes && r.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AssignAddresses calls Network.AssignAddresses for each network.
+func (s *Spec) AssignAddresses() error {
+	for i := range s.Networks {
+		err := s.Networks[i].AssignAddresses()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcastAddress returns the broadcast address of r, if r is an IPv4 network larger than /31 (which has no broadcast address).
+func broadcastAddress(r net.IPNet) (net.IP, bool) {
+	ip := r.IP.To4()
+	ones, bits := r.Mask.Size()
+	if ip == nil || bits != 32 || ones >= 31 {
+		return nil, false
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = ip[i] | ^r.Mask[i]
+	}
+	return broadcast, true
+}
+
+// hostMask returns the mask for a single address of the same family as ip.
+func hostMask(ip net.IP) net.IPMask {
+	if ip.To4() != nil {
+		return net.CIDRMask(32, 32)
+	}
+	return net.CIDRMask(128, 128)
+}
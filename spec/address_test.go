@@ -0,0 +1,119 @@
+package spec
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/nyiyui/qrystal/goal"
+)
+
+func mustIPNet(s string) goal.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	ipNet.IP = ip
+	return goal.IPNet(*ipNet)
+}
+
+func TestAssignAddresses(t *testing.T) {
+	n := Network{
+		Name:          "qrystal0",
+		AddressRanges: []goal.IPNet{mustIPNet("10.10.0.0/24"), mustIPNet("fd00::/64")},
+		Devices: []NetworkDevice{
+			{NetworkDeviceCensored: NetworkDeviceCensored{Name: "a", Addresses: []goal.IPNet{mustIPNet("10.10.0.1/32")}}},
+			{NetworkDeviceCensored: NetworkDeviceCensored{Name: "b"}},
+			{NetworkDeviceCensored: NetworkDeviceCensored{Name: "c"}},
+		},
+	}
+	err := n.AssignAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"a": {"10.10.0.1/32"},
+		"b": {"10.10.0.2/32", "fd00::1/128"},
+		"c": {"10.10.0.3/32", "fd00::2/128"},
+	}
+	for _, nd := range n.Devices {
+		if len(nd.Addresses) != len(expected[nd.Name]) {
+			t.Fatalf("device %s: got %d addresses, expected %v", nd.Name, len(nd.Addresses), expected[nd.Name])
+		}
+		for i, addr := range nd.Addresses {
+			if got := (*net.IPNet)(&addr).String(); got != expected[nd.Name][i] {
+				t.Fatalf("device %s: got address %s, expected %s", nd.Name, got, expected[nd.Name][i])
+			}
+		}
+	}
+	err = n.Validate()
+	if err != nil {
+		t.Fatalf("assigned addresses are invalid: %s", err)
+	}
+
+	// assigning again must not change anything
+	n2 := n.Clone()
+	err = n2.AssignAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n2.Equal(n) {
+		t.Fatal("assigning twice changed addresses")
+	}
+}
+
+func TestValidateAddresses(t *testing.T) {
+	device := func(name, addr string) NetworkDevice {
+		return NetworkDevice{NetworkDeviceCensored: NetworkDeviceCensored{Name: name, Addresses: []goal.IPNet{mustIPNet(addr)}}}
+	}
+	tests := []struct {
+		name  string
+		n     Network
+		valid bool
+	}{
+		{"ok", Network{Devices: []NetworkDevice{device("a", "10.10.0.1/32"), device("b", "10.10.0.2/32")}}, true},
+		{"duplicate", Network{Devices: []NetworkDevice{device("a", "10.10.0.1/32"), device("b", "10.10.0.1/32")}}, false},
+		{"overlap", Network{Devices: []NetworkDevice{device("a", "10.10.0.0/24"), device("b", "10.10.0.2/32")}}, false},
+		{"in range", Network{AddressRanges: []goal.IPNet{mustIPNet("10.10.0.0/24")}, Devices: []NetworkDevice{device("a", "10.10.0.1/32")}}, true},
+		{"out of range", Network{AddressRanges: []goal.IPNet{mustIPNet("10.10.0.0/24")}, Devices: []NetworkDevice{device("a", "10.10.1.1/32")}}, false},
+		{"larger than range", Network{AddressRanges: []goal.IPNet{mustIPNet("10.10.0.0/24")}, Devices: []NetworkDevice{device("a", "10.10.0.0/16")}}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.n.Name = "qrystal0"
+			err := tc.n.Validate()
+			if tc.valid && err != nil {
+				t.Fatalf("expected valid, got %s", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestAllocateAddressesReserved(t *testing.T) {
+	for _, tc := range []struct {
+		r        string
+		expected []string
+	}{
+		{"10.10.0.0/30", []string{"10.10.0.1/32", "10.10.0.2/32"}},
+		{"10.10.0.0/31", []string{"10.10.0.1/32"}},
+	} {
+		t.Run(tc.r, func(t *testing.T) {
+			var n Network
+			var got []string
+			for range len(tc.expected) + 1 {
+				addresses, err := n.AllocateAddresses([]goal.IPNet{mustIPNet(tc.r)})
+				if err != nil {
+					break
+				}
+				got = append(got, (*net.IPNet)(&addresses[0]).String())
+				n.Devices = append(n.Devices, NetworkDevice{NetworkDeviceCensored: NetworkDeviceCensored{Addresses: addresses}})
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Fatalf("allocated %v, expected %v", got, tc.expected)
+			}
+		})
+	}
+}
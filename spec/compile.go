@@ -19,7 +19,7 @@ func (sc SpecCensored) CompileMachine(name string, ignoreIncomplete bool) (goal.
 		for _, name := range snd.Accessible {
 			forwardee, ok := sn.GetDevice(name)
 			if !ok {
-				panic("malformed spec")
+				return goal.Machine{}, fmt.Errorf("%s/%s: Accessible contains nonexistent device name %s", sn.Name, snd.Name, name)
 			}
 			for _, addr := range forwardee.Addresses {
 				if addr.IP.To4() != nil {
@@ -32,6 +32,7 @@ func (sc SpecCensored) CompileMachine(name string, ignoreIncomplete bool) (goal.
 				}
 			}
 		}
+		// forwardsFor[i] are the devices whose packets are sent to the i-th device (the first hop), to be forwarded (possibly through more forwarders)
 		forwardsFor := make([][]int, len(sn.Devices))
 		for i, snd := range sn.Devices {
 			if i == sndI {
@@ -40,9 +41,18 @@ func (sc SpecCensored) CompileMachine(name string, ignoreIncomplete bool) (goal.
 			if snd.PublicKey == (goal.Key{}) {
 				continue
 			}
-			if snd.ForwarderAndEndpointChosen && snd.UsesForwarder {
-				forwardsFor[snd.ForwarderChosenIndex] = append(forwardsFor[snd.ForwarderChosenIndex], i)
+			if !snd.ForwarderAndEndpointChosen || !snd.UsesForwarder {
+				continue
+			}
+			path, err := sn.pathTo(i)
+			if err != nil {
+				if ignoreIncomplete {
+					zap.S().Debugf("%s/%s cannot be reached through forwarders, ignore: %s", sn.Name, snd.Name, err)
+					continue
+				}
+				return goal.Machine{}, fmt.Errorf("%s/%s cannot be reached through forwarders: %w", sn.Name, snd.Name, err)
 			}
+			forwardsFor[path[0]] = append(forwardsFor[path[0]], i)
 		}
 		peers := make([]goal.InterfacePeer, 0, len(sn.Devices)-1)
 		for i, snd := range sn.Devices {
@@ -62,22 +72,13 @@ func (sc SpecCensored) CompileMachine(name string, ignoreIncomplete bool) (goal.
 				zap.S().Debugf("%s/%s does not have a chosen forwarder and endpoint, proceed with blank Endpoint.", sn.Name, snd.Name)
 			} else {
 				if !snd.UsesForwarder {
-					endpoint = snd.Endpoints[snd.EndpointChosenIndex]
+					endpoint = snd.Endpoints[snd.EndpointChosenIndex].Address
 				} else {
-					forwarder := sn.Devices[snd.ForwarderChosenIndex]
-					if !forwarder.ForwarderAndEndpointChosen {
-						// NOTE: this shouldn't happen; the forwarder should have been checked before this
-						if ignoreIncomplete {
-							zap.S().Debugf("%s/%s has forwarder %s/%s which does not have a chosen forwarder and endpoint, ignore.", sn.Name, snd.Name, sn.Name, forwarder.Name)
-							continue
-						} else {
-							return goal.Machine{}, fmt.Errorf("%s/%s has forwarder %s/%s which does not have a chosen forwarder and endpoint", sn.Name, snd.Name, sn.Name, forwarder.Name)
-						}
-					}
+					// reached through the first hop's peer (see forwardsFor)
 					continue
 				}
 			}
-			allowedIPs := snd.Addresses
+			allowedIPs := slices.Clone(snd.Addresses)
 			thisForwardsFor := forwardsFor[i]
 			for _, j := range thisForwardsFor {
 				forwardee := sn.Devices[j]
@@ -100,11 +101,15 @@ func (sc SpecCensored) CompileMachine(name string, ignoreIncomplete bool) (goal.
 				AllowedIPs:          allowedIPs,
 			})
 		}
+		linkOptions := snd.LinkOptions.Or(sn.LinkOptions)
 		gm.Interfaces = append(gm.Interfaces, goal.Interface{
-			Name:       sn.Name,
-			ListenPort: snd.ListenPort,
-			Addresses:  snd.Addresses,
-			Peers:      peers,
+			Name:         sn.Name,
+			ListenPort:   snd.ListenPort,
+			Addresses:    snd.Addresses,
+			MTU:          linkOptions.MTU,
+			FirewallMark: linkOptions.FirewallMark,
+			Table:        linkOptions.Table,
+			Peers:        peers,
 		})
 	}
 	return gm, nil
@@ -0,0 +1,108 @@
+package spec
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/nyiyui/qrystal/goal"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// forwardingNetwork returns a network censored for a, where x is reached through f1, which is reached through f2.
+func forwardingNetwork(t *testing.T) NetworkCensored {
+	device := func(name, address string) NetworkDeviceCensored {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NetworkDeviceCensored{Name: name, Addresses: []goal.IPNet{mustIPNet(address)}, PublicKey: goal.Key(key.PublicKey())}
+	}
+	nc := NetworkCensored{Name: "qrystal0", CensoredFor: "a", Devices: []NetworkDeviceCensored{
+		device("a", "10.10.0.1/32"),
+		device("x", "10.10.0.2/32"),
+		device("f1", "10.10.0.3/32"),
+		device("f2", "10.10.0.4/32"),
+	}}
+	nc.Devices[1].ForwarderAndEndpointChosen, nc.Devices[1].UsesForwarder, nc.Devices[1].ForwarderChosenIndex = true, true, 2
+	nc.Devices[2].ForwarderAndEndpointChosen, nc.Devices[2].UsesForwarder, nc.Devices[2].ForwarderChosenIndex = true, true, 3
+	nc.Devices[3].ForwarderAndEndpointChosen, nc.Devices[3].Endpoints = true, Endpoints("192.0.2.1:51820")
+	return nc
+}
+
+func TestCompileMachineMultiHop(t *testing.T) {
+	nc := forwardingNetwork(t)
+	gm, err := SpecCensored{Networks: []NetworkCensored{nc}}.CompileMachine("a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := gm.Interfaces[0].Peers
+	if len(peers) != 1 || peers[0].Name != "f2" || peers[0].Endpoint != "192.0.2.1:51820" {
+		t.Fatalf("expected only f2 as a peer, got %#v", peers)
+	}
+	allowedIPs := make([]string, len(peers[0].AllowedIPs))
+	for i, allowedIP := range peers[0].AllowedIPs {
+		allowedIPs[i] = (*net.IPNet)(&allowedIP).String()
+	}
+	slices.Sort(allowedIPs)
+	if expected := []string{"10.10.0.2/32", "10.10.0.3/32", "10.10.0.4/32"}; !slices.Equal(allowedIPs, expected) {
+		t.Fatalf("expected AllowedIPs %v, got %v", expected, allowedIPs)
+	}
+	if len(nc.Devices[3].Addresses) != 1 {
+		t.Fatalf("spec changed: %v", nc.Devices[3].Addresses)
+	}
+
+	path, err := nc.PathTo("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"f2", "f1", "x"}; !slices.Equal(path, expected) {
+		t.Fatalf("expected path %v, got %v", expected, path)
+	}
+	if !nc.CanForwardVia(1, 3) {
+		t.Fatal("x cannot forward via f2")
+	}
+	if nc.CanForwardVia(3, 2) {
+		t.Fatal("f2 can forward via f1, which forwards via f2")
+	}
+}
+
+func TestCompileMachineForwardingErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(nc *NetworkCensored)
+		err    error
+	}{
+		{"loop", func(nc *NetworkCensored) { nc.Devices[3].UsesForwarder, nc.Devices[3].ForwarderChosenIndex = true, 1 }, ErrForwardingLoop},
+		{"self", func(nc *NetworkCensored) { nc.Devices[3].UsesForwarder, nc.Devices[3].ForwarderChosenIndex = true, 0 }, ErrForwardedThroughSelf},
+		{"too many hops", func(nc *NetworkCensored) { nc.MaxForwardingHops = 1 }, ErrTooManyHops},
+		{"not chosen", func(nc *NetworkCensored) { nc.Devices[3].ForwarderAndEndpointChosen = false }, ErrNoEndpointChosen},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nc := forwardingNetwork(t)
+			tc.modify(&nc)
+			_, err := nc.PathTo("x")
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("PathTo: expected %v, got %v", tc.err, err)
+			}
+			sc := SpecCensored{Networks: []NetworkCensored{nc}}
+			_, err = sc.CompileMachine("a", false)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("CompileMachine: expected %v, got %v", tc.err, err)
+			}
+			// x is skipped when ignoring incomplete devices
+			gm, err := sc.CompileMachine("a", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, peer := range gm.Interfaces[0].Peers {
+				for _, allowedIP := range peer.AllowedIPs {
+					if (*net.IPNet)(&allowedIP).String() == "10.10.0.2/32" {
+						t.Fatalf("x reachable through %s", peer.Name)
+					}
+				}
+			}
+		})
+	}
+}
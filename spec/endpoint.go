@@ -0,0 +1,86 @@
+package spec
+
+import (
+	"encoding/json"
+	"net"
+	"slices"
+
+	"github.com/nyiyui/qrystal/goal"
+)
+
+// Endpoint is an address a device is available on, and when to use it.
+// In JSON, an Endpoint can also be a string (the Address only).
+type Endpoint struct {
+	// Address is the host and port (e.g. "server.example.com:51820").
+	Address string
+	// Priority is the priority of this endpoint. Any usable endpoint with a higher priority is chosen over one with a lower priority, regardless of its score.
+	Priority int `json:",omitempty"`
+	// Label describes where the endpoint is reachable from (e.g. "lan", "vpc", or "public").
+	Label string `json:",omitempty"`
+	// SourceNetworks restricts this endpoint to devices with an address in one of these networks (e.g. 10.0.0.0/8 for an address in a VPC).
+	// If empty, any device can use this endpoint.
+	SourceNetworks []goal.IPNet `json:",omitempty"`
+}
+
+func (e Endpoint) String() string {
+	if e.Label == "" {
+		return e.Address
+	}
+	return e.Label + " " + e.Address
+}
+
+// Usable returns whether a device with the given (local) addresses can use this endpoint (see SourceNetworks).
+func (e Endpoint) Usable(localAddrs []net.IP) bool {
+	if len(e.SourceNetworks) == 0 {
+		return true
+	}
+	for _, sourceNetwork := range e.SourceNetworks {
+		ipNet := net.IPNet(sourceNetwork)
+		if slices.ContainsFunc(localAddrs, ipNet.Contains) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Endpoint) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*e = Endpoint{}
+		return json.Unmarshal(data, &e.Address)
+	}
+	type endpoint Endpoint
+	return json.Unmarshal(data, (*endpoint)(e))
+}
+
+// MarshalJSON marshals endpoints with only an Address as a string, so they can be read by older device clients.
+func (e Endpoint) MarshalJSON() ([]byte, error) {
+	if e.Priority == 0 && e.Label == "" && len(e.SourceNetworks) == 0 {
+		return json.Marshal(e.Address)
+	}
+	type endpoint Endpoint
+	return json.Marshal(endpoint(e))
+}
+
+func (a Endpoint) Equal(b Endpoint) bool {
+	return a.Address == b.Address && a.Priority == b.Priority && a.Label == b.Label && slices.EqualFunc(a.SourceNetworks, b.SourceNetworks, ipNetEqual)
+}
+
+func (e Endpoint) Clone() Endpoint {
+	e2 := e
+	if e.SourceNetworks != nil {
+		e2.SourceNetworks = make([]goal.IPNet, len(e.SourceNetworks))
+		for i, sourceNetwork := range e.SourceNetworks {
+			e2.SourceNetworks[i] = cloneIPNet(sourceNetwork)
+		}
+	}
+	return e2
+}
+
+// Endpoints returns endpoints with the given addresses.
+func Endpoints(addresses ...string) []Endpoint {
+	endpoints := make([]Endpoint, len(addresses))
+	for i, address := range addresses {
+		endpoints[i] = Endpoint{Address: address}
+	}
+	return endpoints
+}
@@ -0,0 +1,111 @@
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// ForwarderPolicy is how a forwarder is chosen when a device has more than one (see NetworkCensored.ChooseForwarder).
+type ForwarderPolicy string
+
+const (
+	// ForwarderHash chooses a forwarder by hashing the names of the device and forwarders (rendezvous hashing).
+	// The same forwarder is chosen for a device every time, and adding or removing a forwarder only moves the devices that chose it (or now choose it).
+	ForwarderHash ForwarderPolicy = "hash"
+	// ForwarderLeastLoaded chooses the forwarder that forwards for the fewest devices (as chosen so far), falling back to ForwarderHash for ties.
+	ForwarderLeastLoaded ForwarderPolicy = "least-loaded"
+	// ForwarderLatency chooses the forwarder whose chosen endpoint has the best score, falling back to ForwarderHash for ties (or if no endpoint could be scored).
+	ForwarderLatency ForwarderPolicy = "latency"
+)
+
+// Validate returns an error if the policy is unknown.
+// The zero value is valid, and is the same as ForwarderHash.
+func (p ForwarderPolicy) Validate() error {
+	switch p {
+	case "", ForwarderHash, ForwarderLeastLoaded, ForwarderLatency:
+		return nil
+	default:
+		return fmt.Errorf("unknown forwarder policy %q", p)
+	}
+}
+
+var ErrNoForwarder = errors.New("spec: no forwarder")
+
+// ChooseForwarder chooses one of candidates (indices of nc.Devices, e.g. from GetForwardersFor) to forward packets to the named device, using policy.
+// score is used for ForwarderLatency to score the endpoint chosen for each forwarder; it is run in separate goroutines for each forwarder.
+// If there are no candidates, ErrNoForwarder is returned.
+func (nc NetworkCensored) ChooseForwarder(forwardee string, candidates []int, policy ForwarderPolicy, score EndpointScorer) (int, error) {
+	if len(candidates) == 0 {
+		return 0, ErrNoForwarder
+	}
+	// ranks[i] is the rank of candidates[i] (higher is better) before falling back to hashing
+	ranks := make([]int, len(candidates))
+	switch policy {
+	case "", ForwarderHash:
+	case ForwarderLeastLoaded:
+		loads := nc.forwarderLoads()
+		for i, j := range candidates {
+			ranks[i] = -loads[j]
+		}
+	case ForwarderLatency:
+		scores := make([]int, len(candidates))
+		errs := make([]error, len(candidates))
+		var wg sync.WaitGroup
+		for i, j := range candidates {
+			ndc := nc.Devices[j]
+			if !ndc.ForwarderAndEndpointChosen || ndc.UsesForwarder {
+				errs[i] = errors.New("no endpoint chosen")
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				scores[i], errs[i] = score(ndc.Endpoints[ndc.EndpointChosenIndex].Address)
+				zap.S().Debugf("%s: forwarder %s: score=%d, err=%v", forwardee, ndc.Name, scores[i], errs[i])
+			}()
+		}
+		wg.Wait()
+		for i := range candidates {
+			if errs[i] != nil {
+				ranks[i] = math.MinInt
+			} else {
+				ranks[i] = scores[i]
+			}
+		}
+	default:
+		return 0, policy.Validate()
+	}
+	best := -1
+	var bestHash uint64
+	for i, j := range candidates {
+		hash := rendezvousHash(forwardee, nc.Devices[j].Name)
+		if best == -1 || ranks[i] > ranks[best] || ranks[i] == ranks[best] && hash > bestHash {
+			best, bestHash = i, hash
+		}
+	}
+	return candidates[best], nil
+}
+
+// forwarderLoads returns the number of devices using each device (by index) as a forwarder.
+func (nc NetworkCensored) forwarderLoads() map[int]int {
+	loads := map[int]int{}
+	for _, ndc := range nc.Devices {
+		if ndc.ForwarderAndEndpointChosen && ndc.UsesForwarder {
+			loads[ndc.ForwarderChosenIndex]++
+		}
+	}
+	return loads
+}
+
+func rendezvousHash(forwardee, forwarder string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(forwardee))
+	h.Write([]byte{0})
+	h.Write([]byte(forwarder))
+	return h.Sum64()
+}
@@ -0,0 +1,74 @@
+package spec
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChooseForwarder(t *testing.T) {
+	nc := NetworkCensored{Devices: []NetworkDeviceCensored{
+		{Name: "a", Endpoints: Endpoints("a:1"), ForwarderAndEndpointChosen: true},
+		{Name: "b", Endpoints: Endpoints("b:1"), ForwarderAndEndpointChosen: true},
+		{Name: "c", Endpoints: Endpoints("c:1"), ForwarderAndEndpointChosen: true},
+		{Name: "x", ForwarderAndEndpointChosen: true, UsesForwarder: true, ForwarderChosenIndex: 0},
+		{Name: "y", ForwarderAndEndpointChosen: true, UsesForwarder: true, ForwarderChosenIndex: 1},
+		{Name: "z"},
+	}}
+	scorer := func(endpoint string) (int, error) {
+		switch endpoint {
+		case "a:1":
+			return -20, nil
+		case "b:1":
+			return -10, nil
+		default:
+			return 0, errors.New("unreachable")
+		}
+	}
+
+	_, err := nc.ChooseForwarder("z", nil, ForwarderHash, scorer)
+	if !errors.Is(err, ErrNoForwarder) {
+		t.Fatalf("expected ErrNoForwarder, got %v", err)
+	}
+
+	// the same forwarder is chosen regardless of order, and other forwarders being added
+	j, err := nc.ChooseForwarder("z", []int{0, 1}, ForwarderHash, scorer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j2, err := nc.ChooseForwarder("z", []int{1, 0}, ForwarderHash, scorer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j != j2 {
+		t.Fatalf("hash depends on order: %d and %d", j, j2)
+	}
+	j3, err := nc.ChooseForwarder("z", []int{2, 1, 0}, ForwarderHash, scorer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j3 != 2 && j3 != j {
+		t.Fatalf("adding a forwarder moved z from %d to %d", j, j3)
+	}
+
+	// a and b forward for one device each
+	j, err = nc.ChooseForwarder("z", []int{0, 1, 2}, ForwarderLeastLoaded, scorer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j != 2 {
+		t.Fatalf("least-loaded: chose %d, expected 2", j)
+	}
+
+	j, err = nc.ChooseForwarder("z", []int{0, 1, 2}, ForwarderLatency, scorer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j != 1 {
+		t.Fatalf("latency: chose %d, expected 1", j)
+	}
+
+	_, err = nc.ChooseForwarder("z", []int{0}, "bogus", scorer)
+	if err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
@@ -0,0 +1,82 @@
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// DefaultMaxForwardingHops is the maximum number of forwarders packets to a device can pass through, if Network.MaxForwardingHops is 0.
+const DefaultMaxForwardingHops = 3
+
+var (
+	ErrForwardingLoop       = errors.New("spec: forwarding loop")
+	ErrTooManyHops          = errors.New("spec: too many forwarding hops")
+	ErrNoEndpointChosen     = errors.New("spec: no endpoint or forwarder chosen")
+	ErrForwardedThroughSelf = errors.New("spec: forwarded through this device")
+)
+
+func (nc NetworkCensored) maxForwardingHops() int {
+	if nc.MaxForwardingHops == 0 {
+		return DefaultMaxForwardingHops
+	}
+	return nc.MaxForwardingHops
+}
+
+// PathTo returns the names of the devices packets from nc.CensoredFor to the named device pass through, following the chosen forwarders.
+// The first name is the first hop (the peer whose AllowedIPs include the named device's addresses), and the last name is the named device itself.
+// An error is returned if the named device cannot be reached: if the forwarders form a loop (ErrForwardingLoop) or pass through nc.CensoredFor (ErrForwardedThroughSelf), if there are more forwarders than allowed by MaxForwardingHops (ErrTooManyHops), or if a device on the way has no endpoint or forwarder chosen (ErrNoEndpointChosen).
+func (nc NetworkCensored) PathTo(name string) ([]string, error) {
+	i, ok := nc.GetDeviceIndex(name)
+	if !ok {
+		return nil, fmt.Errorf("device %s not found", name)
+	}
+	path, err := nc.pathTo(i)
+	names := make([]string, len(path))
+	for j, k := range path {
+		names[j] = nc.Devices[k].Name
+	}
+	return names, err
+}
+
+// pathTo is like PathTo, but uses device indices.
+// On error, the path found so far (ending at the i-th device) is returned.
+func (nc NetworkCensored) pathTo(i int) ([]int, error) {
+	self, _ := nc.GetDeviceIndex(nc.CensoredFor)
+	path := []int{i}
+	for {
+		ndc := nc.Devices[path[0]]
+		if !ndc.ForwarderAndEndpointChosen {
+			return path, fmt.Errorf("%s: %w", ndc.Name, ErrNoEndpointChosen)
+		}
+		if !ndc.UsesForwarder {
+			return path, nil
+		}
+		next := ndc.ForwarderChosenIndex
+		if next < 0 || next >= len(nc.Devices) {
+			return path, fmt.Errorf("%s: forwarder index %d out of range", ndc.Name, next)
+		}
+		if next == self {
+			return path, fmt.Errorf("%s: %w", ndc.Name, ErrForwardedThroughSelf)
+		}
+		if slices.Contains(path, next) {
+			return path, fmt.Errorf("%s: forwarder %s: %w", ndc.Name, nc.Devices[next].Name, ErrForwardingLoop)
+		}
+		path = append([]int{next}, path...)
+		if len(path)-1 > nc.maxForwardingHops() {
+			return path, fmt.Errorf("%s: more than %d forwarders: %w", nc.Devices[i].Name, nc.maxForwardingHops(), ErrTooManyHops)
+		}
+	}
+}
+
+// CanForwardVia returns whether the forwardee-th device can use the forwarder-th device as its forwarder (without a loop, or too many forwarders).
+func (nc NetworkCensored) CanForwardVia(forwardee, forwarder int) bool {
+	if forwardee == forwarder {
+		return false
+	}
+	path, err := nc.pathTo(forwarder)
+	if err != nil {
+		return false
+	}
+	return !slices.Contains(path, forwardee) && len(path) <= nc.maxForwardingHops()
+}
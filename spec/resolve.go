@@ -3,6 +3,7 @@ package spec
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"os/exec"
@@ -34,45 +35,42 @@ func PingCommandScorer(endpoint string) (int, error) {
 var ErrAllEndpointsBad = errors.New("spec: all endpoints are bad")
 
 // ChooseEndpoint chooses an endpoint and forwarder using the score function provided.
-// If the score returned is tied, the first endpoint (in NetworkDeviceCensored.Endpoints) is chosen.
+// Only endpoints usable from localAddrs (the addresses of this device, see Endpoint.Usable) are considered.
+// The endpoint with the highest Priority is chosen, then the one with the highest score; remaining ties are broken by the order of NetworkDeviceCensored.Endpoints (earlier endpoints are preferred).
 // The score function is run in separate goroutines for each endpoint.
-// If all scorers return an error, a forwarder is chosen instead.
-func (ndc *NetworkDeviceCensored) ChooseEndpoint(score EndpointScorer) error {
-	// TODO: if all endpoints fail, randomly choose a forwarder (look in ForwardsFor)
+// If all scorers return an error (or no endpoints are usable), ErrAllEndpointsBad is returned (and a forwarder should be chosen instead).
+func (ndc *NetworkDeviceCensored) ChooseEndpoint(score EndpointScorer, localAddrs []net.IP) error {
 	scores := make([]int, len(ndc.Endpoints))
 	errs := make([]error, len(ndc.Endpoints))
 	var wg sync.WaitGroup
 	for i, endpoint := range ndc.Endpoints {
+		if !endpoint.Usable(localAddrs) {
+			errs[i] = fmt.Errorf("%s: not usable from this device", endpoint)
+			continue
+		}
 		wg.Add(1)
-		go func(i int, endpoint string) {
-			scores[i], errs[i] = score(endpoint)
-			zap.S().Debugf("%d: score=%d, err=%s", i, scores[i], errs[i])
-			wg.Done()
-		}(i, endpoint)
+		go func() {
+			defer wg.Done()
+			scores[i], errs[i] = score(endpoint.Address)
+			zap.S().Debugf("%s: endpoint %d (%s): score=%d, err=%v", ndc.Name, i, endpoint, scores[i], errs[i])
+		}()
 	}
 	wg.Wait()
-	ok := false
-	for _, err := range errs {
-		if err == nil {
-			ok = true
-		}
-	}
-	if !ok {
-		// all scorers returned an error - try forwarders
-		return fmt.Errorf("all scorers returned an error: %w", ErrAllEndpointsBad)
-	}
 	maxI := -1
-	maxScore := -1
+	maxPriority := math.MinInt
+	maxScore := math.MinInt
 	for i, score := range scores {
 		if errs[i] != nil {
 			continue
 		}
-		if score > maxScore {
-			maxI, maxScore = i, score
+		priority := ndc.Endpoints[i].Priority
+		// strictly greater, so the earliest endpoint wins ties
+		if maxI == -1 || priority > maxPriority || priority == maxPriority && score > maxScore {
+			maxI, maxPriority, maxScore = i, priority, score
 		}
 	}
 	if maxI == -1 {
-		panic("unreachable")
+		return fmt.Errorf("all scorers returned an error: %w", errors.Join(append(errs, ErrAllEndpointsBad)...))
 	}
 	ndc.EndpointChosenIndex = maxI
 	ndc.ForwarderAndEndpointChosen = true
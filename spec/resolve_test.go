@@ -0,0 +1,146 @@
+package spec
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nyiyui/qrystal/goal"
+)
+
+func TestChooseEndpoint(t *testing.T) {
+	scores := map[string]int{"a:1": -30, "b:1": -10, "c:1": -10}
+	scorer := func(endpoint string) (int, error) {
+		score, ok := scores[endpoint]
+		if !ok {
+			return 0, errors.New("unreachable")
+		}
+		return score, nil
+	}
+
+	// negative scores (e.g. RTTScore) are chosen, and ties go to the earlier endpoint
+	ndc := NetworkDeviceCensored{Name: "a", Endpoints: Endpoints("x:1", "a:1", "c:1", "b:1")}
+	err := ndc.ChooseEndpoint(scorer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ndc.ForwarderAndEndpointChosen || ndc.EndpointChosenIndex != 2 {
+		t.Fatalf("chose %d (%t), expected 2", ndc.EndpointChosenIndex, ndc.ForwarderAndEndpointChosen)
+	}
+
+	ndc = NetworkDeviceCensored{Name: "a", Endpoints: Endpoints("x:1", "y:1")}
+	err = ndc.ChooseEndpoint(scorer, nil)
+	if !errors.Is(err, ErrAllEndpointsBad) {
+		t.Fatalf("expected ErrAllEndpointsBad, got %v", err)
+	}
+	if ndc.ForwarderAndEndpointChosen {
+		t.Fatal("endpoint chosen")
+	}
+
+	// higher priorities win over higher scores, unless they are not usable from this device
+	vpc := mustIPNet("10.0.0.0/8")
+	ndc = NetworkDeviceCensored{Name: "a", Endpoints: []Endpoint{
+		{Address: "b:1"},
+		{Address: "a:1", Priority: 1, Label: "public"},
+		{Address: "c:1", Priority: 2, Label: "vpc", SourceNetworks: []goal.IPNet{vpc}},
+	}}
+	err = ndc.ChooseEndpoint(scorer, []net.IP{net.IPv4(192, 168, 0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ndc.EndpointChosenIndex != 1 {
+		t.Fatalf("chose %d, expected 1", ndc.EndpointChosenIndex)
+	}
+	err = ndc.ChooseEndpoint(scorer, []net.IP{net.IPv4(192, 168, 0, 2), net.IPv4(10, 1, 2, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ndc.EndpointChosenIndex != 2 {
+		t.Fatalf("chose %d, expected 2", ndc.EndpointChosenIndex)
+	}
+}
+
+func TestEndpointJSON(t *testing.T) {
+	var endpoints []Endpoint
+	err := json.Unmarshal([]byte(`["a.example.com:51820", {"Address": "10.0.0.1:51820", "Priority": 1, "Label": "vpc", "SourceNetworks": ["10.0.0.0/8"]}]`), &endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Endpoint{
+		{Address: "a.example.com:51820"},
+		{Address: "10.0.0.1:51820", Priority: 1, Label: "vpc", SourceNetworks: []goal.IPNet{mustIPNet("10.0.0.0/8")}},
+	}
+	if !slices.EqualFunc(endpoints, expected, Endpoint.Equal) {
+		t.Fatalf("unexpected endpoints: %v", endpoints)
+	}
+	data, err := json.Marshal(endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// plain endpoints are still strings, for older device clients
+	if s := string(data); s != `["a.example.com:51820",{"Address":"10.0.0.1:51820","Priority":1,"Label":"vpc","SourceNetworks":["10.0.0.0/8"]}]` {
+		t.Fatalf("unexpected JSON: %s", s)
+	}
+}
+
+func TestTCPScorer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	// the WireGuard port in the endpoint is replaced by the TCP port
+	scorer := TCPScorer(port, time.Second)
+	score, err := scorer("127.0.0.1:51820")
+	if err != nil {
+		t.Fatalf("listening port: %s", err)
+	}
+	if score > 0 {
+		t.Fatalf("expected a score from RTTScore, got %d", score)
+	}
+	l.Close()
+	_, err = scorer("127.0.0.1:51820")
+	if err == nil {
+		t.Fatal("closed port: expected error")
+	}
+}
+
+func TestScorerConfig(t *testing.T) {
+	c := ScorerConfig{Kind: ScorerWeighted, Scorers: []ScorerConfig{
+		{Kind: ScorerPingRTT, Timeout: 0},
+		{Kind: "bogus"},
+	}}
+	_, err := c.Scorer()
+	if err == nil || err.Error() != `Scorers[1].Kind: unknown "bogus"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = ScorerConfig{Kind: ScorerTCP}.Scorer()
+	if err == nil {
+		t.Fatal("tcp without Port: expected error")
+	}
+
+	constant := func(score int) EndpointScorer {
+		return func(string) (int, error) { return score, nil }
+	}
+	scorer := CombineScorers([]WeightedScorer{{constant(-5), 2}, {constant(3), 1}})
+	score, err := scorer("a:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if score != -7 {
+		t.Fatalf("expected -7, got %d", score)
+	}
+}
+
+func TestParsePingRTT(t *testing.T) {
+	rtt, err := parsePingRTT("64 bytes from 127.0.0.1: icmp_seq=1 ttl=64 time=0.045 ms\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt != 45*time.Microsecond {
+		t.Fatalf("expected 45µs, got %s", rtt)
+	}
+}
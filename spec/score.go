@@ -0,0 +1,170 @@
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/nyiyui/qrystal/goal"
+)
+
+// defaultScorerTimeout is the timeout used by scorers when ScorerConfig.Timeout is not set.
+const defaultScorerTimeout = 4 * time.Second
+
+// RTTScore converts a round-trip time into a score (higher is better), so lower latencies are preferred.
+// The score is the negated RTT in microseconds.
+func RTTScore(rtt time.Duration) int {
+	return -int(rtt / time.Microsecond)
+}
+
+// TCPScorer returns a scorer that connects to the endpoint's host on the given TCP port, and scores it by the time taken to connect (see RTTScore).
+// This is useful when the host runs a TCP service (e.g. SSH) reachable the same way as WireGuard.
+// The endpoint's own port is WireGuard's UDP port, so port must be given.
+func TCPScorer(port int, timeout time.Duration) EndpointScorer {
+	return func(endpoint string) (int, error) {
+		host, _, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return 0, err
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return 0, err
+		}
+		rtt := time.Since(start)
+		conn.Close()
+		return RTTScore(rtt), nil
+	}
+}
+
+var pingTimePattern = regexp.MustCompile(`time[=<]([0-9.]+) ?ms`)
+
+// PingRTTScorer returns a scorer that pings the endpoint's host like PingCommandScorer, and scores it by the round-trip time reported (see RTTScore).
+func PingRTTScorer(timeout time.Duration) EndpointScorer {
+	return func(endpoint string) (int, error) {
+		udpAddr, err := net.ResolveUDPAddr("udp", endpoint)
+		if err != nil {
+			return 0, err
+		}
+		deadline := int((timeout + time.Second - 1) / time.Second)
+		out, err := exec.Command("ping", "-c", "1", "-w", strconv.Itoa(deadline), "--", udpAddr.IP.String()).Output()
+		if err != nil {
+			return 0, err
+		}
+		rtt, err := parsePingRTT(string(out))
+		if err != nil {
+			return 0, err
+		}
+		return RTTScore(rtt), nil
+	}
+}
+
+// parsePingRTT returns the round-trip time in the output of the ping command.
+func parsePingRTT(out string) (time.Duration, error) {
+	match := pingTimePattern.FindStringSubmatch(out)
+	if match == nil {
+		return 0, errors.New("no round-trip time in ping output")
+	}
+	ms, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse round-trip time: %w", err)
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
+// WeightedScorer is a scorer and the weight to multiply its scores by.
+type WeightedScorer struct {
+	Scorer EndpointScorer
+	Weight int
+}
+
+// CombineScorers returns a scorer that sums the weighted scores of all scorers.
+// An endpoint is bad (i.e. an error is returned) if any scorer returns an error.
+func CombineScorers(scorers []WeightedScorer) EndpointScorer {
+	return func(endpoint string) (int, error) {
+		sum := 0
+		for i, ws := range scorers {
+			score, err := ws.Scorer(endpoint)
+			if err != nil {
+				return 0, fmt.Errorf("scorer %d: %w", i, err)
+			}
+			sum += ws.Weight * score
+		}
+		return sum, nil
+	}
+}
+
+// ScorerKind is the kind of scorer configured by a ScorerConfig.
+type ScorerKind string
+
+const (
+	// ScorerPing is PingCommandScorer.
+	ScorerPing ScorerKind = "ping"
+	// ScorerPingRTT is PingRTTScorer.
+	ScorerPingRTT ScorerKind = "ping-rtt"
+	// ScorerTCP is TCPScorer.
+	ScorerTCP ScorerKind = "tcp"
+	// ScorerWeighted is CombineScorers, with the scorers in ScorerConfig.Scorers.
+	ScorerWeighted ScorerKind = "weighted"
+)
+
+// ScorerConfig configures an EndpointScorer (e.g. in a config file).
+type ScorerConfig struct {
+	Kind ScorerKind
+	// Timeout is how long to wait for a probe. Defaults to 4 seconds.
+	Timeout goal.Duration
+	// Port is the TCP port to connect to, for ScorerTCP (required).
+	Port int
+	// Weight is the weight of this scorer, for scorers in ScorerWeighted. Defaults to 1.
+	Weight int
+	// Scorers are the scorers to combine, for ScorerWeighted.
+	Scorers []ScorerConfig
+}
+
+// Scorer returns the scorer configured.
+// The zero value returns PingCommandScorer.
+func (c ScorerConfig) Scorer() (EndpointScorer, error) {
+	timeout := time.Duration(c.Timeout)
+	if timeout == 0 {
+		timeout = defaultScorerTimeout
+	}
+	switch c.Kind {
+	case "", ScorerPing:
+		return PingCommandScorer, nil
+	case ScorerPingRTT:
+		return PingRTTScorer(timeout), nil
+	case ScorerTCP:
+		if c.Port == 0 {
+			// the endpoint's port is WireGuard's UDP port
+			return nil, errors.New("Port: required")
+		}
+		if c.Port < 0 || c.Port > 65535 {
+			return nil, fmt.Errorf("Port: out of range: %d", c.Port)
+		}
+		return TCPScorer(c.Port, timeout), nil
+	case ScorerWeighted:
+		if len(c.Scorers) == 0 {
+			return nil, errors.New("Scorers: empty")
+		}
+		scorers := make([]WeightedScorer, len(c.Scorers))
+		for i, sc := range c.Scorers {
+			scorer, err := sc.Scorer()
+			if err != nil {
+				return nil, fmt.Errorf("Scorers[%d].%w", i, err)
+			}
+			weight := sc.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			scorers[i] = WeightedScorer{Scorer: scorer, Weight: weight}
+		}
+		return CombineScorers(scorers), nil
+	default:
+		return nil, fmt.Errorf("Kind: unknown %q", c.Kind)
+	}
+}
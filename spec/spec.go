@@ -67,6 +67,37 @@ func (s SpecCensored) GetNetworkIndex(name string) (i int, ok bool) {
 type Network struct {
 	Name    string
 	Devices []NetworkDevice
+	// AddressRanges are the IP networks (IPv4 and/or IPv6) that addresses are allocated from for devices without Addresses.
+	// If set, all addresses of devices must be inside one of these.
+	AddressRanges []goal.IPNet
+	// MaxForwardingHops is the maximum number of forwarders packets to a device can pass through (see NetworkCensored.PathTo).
+	// If 0, DefaultMaxForwardingHops is used.
+	MaxForwardingHops int `json:",omitempty"`
+	// LinkOptions are the defaults for devices that do not set them.
+	LinkOptions
+}
+
+// LinkOptions are options for the WireGuard interface of a device.
+// Zero values mean the default (see goal.Interface).
+type LinkOptions struct {
+	MTU          int `json:",omitempty"`
+	FirewallMark int `json:",omitempty"`
+	// Table is the routing table routes to peers are added to.
+	Table int `json:",omitempty"`
+}
+
+// Or returns o, with zero values replaced by the values in defaults.
+func (o LinkOptions) Or(defaults LinkOptions) LinkOptions {
+	if o.MTU == 0 {
+		o.MTU = defaults.MTU
+	}
+	if o.FirewallMark == 0 {
+		o.FirewallMark = defaults.FirewallMark
+	}
+	if o.Table == 0 {
+		o.Table = defaults.Table
+	}
+	return o
 }
 
 func (n Network) GetDevice(name string) (nd NetworkDevice, ok bool) {
@@ -82,18 +113,29 @@ func (n Network) GetDeviceIndex(name string) (i int, ok bool) {
 	return i, i != -1
 }
 
+func (a Network) Equal(b Network) bool {
+	return a.Name == b.Name && slices.EqualFunc(a.Devices, b.Devices, func(a, b NetworkDevice) bool { return a.Equal(b) }) && slices.EqualFunc(a.AddressRanges, b.AddressRanges, ipNetEqual) && a.MaxForwardingHops == b.MaxForwardingHops && a.LinkOptions == b.LinkOptions
+}
+
 func (n Network) Clone() Network {
 	devices := make([]NetworkDevice, len(n.Devices))
 	for i, nd := range n.Devices {
 		devices[i] = nd.Clone()
 	}
-	return Network{n.Name, devices}
+	addressRanges := make([]goal.IPNet, len(n.AddressRanges))
+	for i, r := range n.AddressRanges {
+		addressRanges[i] = cloneIPNet(r)
+	}
+	return Network{n.Name, devices, addressRanges, n.MaxForwardingHops, n.LinkOptions}
 }
 
 type NetworkCensored struct {
 	Name        string
 	Devices     []NetworkDeviceCensored
 	CensoredFor string
+	// MaxForwardingHops is Network.MaxForwardingHops.
+	MaxForwardingHops int `json:",omitempty"`
+	LinkOptions
 }
 
 func (nc NetworkCensored) GetDevice(name string) (ndc NetworkDeviceCensored, ok bool) {
@@ -121,11 +163,11 @@ func (nc NetworkCensored) GetForwardersFor(name string) []int {
 }
 
 func (a NetworkCensored) Equal(b NetworkCensored) bool {
-	return a.Name == b.Name && slices.EqualFunc(a.Devices, b.Devices, func(a, b NetworkDeviceCensored) bool { return a.Equal(b) }) && a.CensoredFor == b.CensoredFor
+	return a.Name == b.Name && slices.EqualFunc(a.Devices, b.Devices, func(a, b NetworkDeviceCensored) bool { return a.Equal(b) }) && a.CensoredFor == b.CensoredFor && a.MaxForwardingHops == b.MaxForwardingHops && a.LinkOptions == b.LinkOptions
 }
 
 func (n Network) CensorForDevice(censorFor string) NetworkCensored {
-	nc := NetworkCensored{Name: n.Name, CensoredFor: censorFor}
+	nc := NetworkCensored{Name: n.Name, CensoredFor: censorFor, MaxForwardingHops: n.MaxForwardingHops, LinkOptions: n.LinkOptions}
 	i := slices.IndexFunc(n.Devices, func(nd NetworkDevice) bool { return nd.Name == censorFor })
 	if i == -1 {
 		panic("censorFor device not in Network.Devices")
@@ -169,8 +211,8 @@ func (nd *NetworkDevice) UnmarshalJSON(data []byte) error {
 
 type NetworkDeviceCensored struct {
 	Name string
-	// Endpoints is a unordered list of endpoints on which the peer is available on.
-	Endpoints []string
+	// Endpoints is a list of endpoints on which the peer is available on (see ChooseEndpoint for which is used).
+	Endpoints []Endpoint
 	// EndpointChosen is whether the endpoint was chosen.
 	// This value should always be false on the server.
 	ForwarderAndEndpointChosen bool
@@ -197,14 +239,15 @@ type NetworkDeviceCensored struct {
 	// This can be set by this peer.
 	PersistentKeepalive goal.Duration
 	// Accessible is the list of devices (in the same network) that this peer has access to, and can fowrard packets to.
-	// Note that IPv6 forwarding is not supported yet.
 	// This can be set by this peer.
 	Accessible []string
+	// LinkOptions override the network's LinkOptions for this device.
+	LinkOptions
 }
 
 type networkDeviceCensoredJSON struct {
 	Name                string
-	Endpoints           []string
+	Endpoints           []Endpoint
 	Addresses           []goal.IPNet
 	ListenPort          int
 	PublicKey           goal.Key
@@ -212,6 +255,7 @@ type networkDeviceCensoredJSON struct {
 	PresharedKeyPath    string
 	PersistentKeepalive goal.Duration
 	Accessible          []string
+	LinkOptions
 }
 
 func (ndc *NetworkDeviceCensored) UnmarshalJSON(data []byte) error {
@@ -239,35 +283,45 @@ func (ndc *NetworkDeviceCensored) UnmarshalJSON(data []byte) error {
 	ndc.PresharedKey = ndcj.PresharedKey
 	ndc.PersistentKeepalive = ndcj.PersistentKeepalive
 	ndc.Accessible = ndcj.Accessible
+	ndc.LinkOptions = ndcj.LinkOptions
 	return nil
 }
 
+func cloneIPNet(in goal.IPNet) goal.IPNet {
+	return goal.IPNet{IP: slices.Clone(in.IP), Mask: slices.Clone(in.Mask)}
+}
+
 func ipNetEqual(a, b goal.IPNet) bool {
 	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
 }
 
 func (a NetworkDeviceCensored) Equal(b NetworkDeviceCensored) bool {
-	return a.Name == b.Name && slices.Equal(a.Endpoints, b.Endpoints) && slices.EqualFunc(a.Addresses, b.Addresses, ipNetEqual) && a.ListenPort == b.ListenPort && a.PublicKey == b.PublicKey && (a.PresharedKey != nil && b.PresharedKey != nil && *a.PresharedKey == *b.PresharedKey || a.PresharedKey == nil && b.PresharedKey == nil) && a.PersistentKeepalive == b.PersistentKeepalive && slices.Equal(a.Accessible, b.Accessible)
+	return a.Name == b.Name && slices.EqualFunc(a.Endpoints, b.Endpoints, Endpoint.Equal) && slices.EqualFunc(a.Addresses, b.Addresses, ipNetEqual) && a.ListenPort == b.ListenPort && a.PublicKey == b.PublicKey && (a.PresharedKey != nil && b.PresharedKey != nil && *a.PresharedKey == *b.PresharedKey || a.PresharedKey == nil && b.PresharedKey == nil) && a.PersistentKeepalive == b.PersistentKeepalive && slices.Equal(a.Accessible, b.Accessible) && a.LinkOptions == b.LinkOptions
 }
 
 func (ndc NetworkDeviceCensored) Clone() NetworkDeviceCensored {
 	ndc2 := NetworkDeviceCensored{
 		Name:                       ndc.Name,
 		ForwarderAndEndpointChosen: ndc.ForwarderAndEndpointChosen,
+		UsesForwarder:              ndc.UsesForwarder,
 		EndpointChosenIndex:        ndc.EndpointChosenIndex,
 		ForwarderChosenIndex:       ndc.ForwarderChosenIndex,
 		ListenPort:                 ndc.ListenPort,
 		PublicKey:                  ndc.PublicKey,
 		PersistentKeepalive:        ndc.PersistentKeepalive,
+		LinkOptions:                ndc.LinkOptions,
+	}
+	ndc2.Endpoints = make([]Endpoint, len(ndc.Endpoints))
+	for i, endpoint := range ndc.Endpoints {
+		ndc2.Endpoints[i] = endpoint.Clone()
 	}
-	ndc2.Endpoints = make([]string, len(ndc.Endpoints))
-	copy(ndc2.Endpoints, ndc.Endpoints)
 	ndc2.Addresses = make([]goal.IPNet, len(ndc.Addresses))
 	for i, addr := range ndc.Addresses {
-		ndc2.Addresses[i].IP = make([]byte, len(addr.IP))
-		copy(ndc2.Addresses[i].IP, addr.IP)
-		ndc2.Addresses[i].Mask = make([]byte, len(addr.Mask))
-		copy(ndc2.Addresses[i].Mask, addr.Mask)
+		ndc2.Addresses[i] = cloneIPNet(addr)
+	}
+	if ndc.Accessible != nil {
+		ndc2.Accessible = make([]string, len(ndc.Accessible))
+		copy(ndc2.Accessible, ndc.Accessible)
 	}
 	if ndc.PresharedKey != nil {
 		presharedKey := new(goal.Key)
@@ -0,0 +1,166 @@
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MaxNetworkNameLength is the maximum length of a network name.
+// Network names are used as interface names, which are limited to 15 bytes on Linux.
+const MaxNetworkNameLength = 15
+
+// ValidationError is a problem found at a specific place in a spec.
+type ValidationError struct {
+	// Path is the location of the problem, e.g. Networks[0].Devices[3].Addresses[1].
+	Path string
+	Err  error
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is a list of all problems found in a spec.
+type ValidationErrors []ValidationError
+
+func (es ValidationErrors) Error() string {
+	lines := make([]string, len(es))
+	for i, e := range es {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) addf(path string, format string, args ...any) {
+	v.errs = append(v.errs, ValidationError{Path: path, Err: fmt.Errorf(format, args...)})
+}
+
+// err returns ValidationErrors if there are any problems, and nil otherwise.
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks the spec for problems.
+// If there are any, Validate returns ValidationErrors containing every problem found.
+func (s Spec) Validate() error {
+	var v validator
+	names := map[string]int{}
+	for i, sn := range s.Networks {
+		path := fmt.Sprintf("Networks[%d]", i)
+		if j, ok := names[sn.Name]; ok {
+			v.addf(path+".Name", "duplicate network name %q (same as Networks[%d])", sn.Name, j)
+		} else {
+			names[sn.Name] = i
+		}
+		sn.validate(&v, path)
+	}
+	return v.err()
+}
+
+// Validate checks the network for problems, like Spec.Validate.
+func (n Network) Validate() error {
+	var v validator
+	n.validate(&v, "")
+	return v.err()
+}
+
+func (n Network) validate(v *validator, path string) {
+	prefix := path
+	if prefix != "" {
+		prefix += "."
+	}
+	switch {
+	case n.Name == "":
+		v.addf(prefix+"Name", "must not be blank")
+	case len(n.Name) > MaxNetworkNameLength:
+		v.addf(prefix+"Name", "%q is longer than %d bytes, and cannot be used as an interface name", n.Name, MaxNetworkNameLength)
+	case n.Name == "." || n.Name == ".." || strings.ContainsAny(n.Name, "/: \t\n"):
+		v.addf(prefix+"Name", "%q cannot be used as an interface name", n.Name)
+	}
+	n.LinkOptions.validate(v, prefix)
+	if n.MaxForwardingHops < 0 {
+		v.addf(prefix+"MaxForwardingHops", "must not be negative")
+	}
+	names := map[string]int{}
+	for i, nd := range n.Devices {
+		path := fmt.Sprintf("%sDevices[%d]", prefix, i)
+		if nd.Name == "" {
+			v.addf(path+".Name", "must not be blank")
+		} else if j, ok := names[nd.Name]; ok {
+			v.addf(path+".Name", "duplicate device name %q (same as Devices[%d])", nd.Name, j)
+		} else {
+			names[nd.Name] = i
+		}
+		for j, endpoint := range nd.Endpoints {
+			err := validateEndpoint(endpoint.Address)
+			if err != nil {
+				v.addf(fmt.Sprintf("%s.Endpoints[%d]", path, j), "%w", err)
+			}
+		}
+		if nd.ListenPort < 0 || nd.ListenPort > 65535 {
+			v.addf(path+".ListenPort", "%d is out of range", nd.ListenPort)
+		}
+		if nd.PersistentKeepalive < 0 {
+			v.addf(path+".PersistentKeepalive", "must not be negative")
+		}
+		nd.LinkOptions.validate(v, path+".")
+		err := nd.AccessControl.Validate()
+		if err != nil {
+			v.addf(path+".AccessOnly", "%w", err)
+		}
+		for j, name := range nd.AccessOnly {
+			if _, ok := n.GetDevice(name); !ok {
+				v.addf(fmt.Sprintf("%s.AccessOnly[%d]", path, j), "nonexistent device name %q", name)
+			}
+		}
+		for j, name := range nd.Accessible {
+			if _, ok := n.GetDevice(name); !ok {
+				v.addf(fmt.Sprintf("%s.Accessible[%d]", path, j), "nonexistent device name %q", name)
+			}
+		}
+	}
+	n.validateAddresses(v, prefix)
+}
+
+func (o LinkOptions) validate(v *validator, prefix string) {
+	if o.MTU != 0 && (o.MTU < 68 || o.MTU > 65535) {
+		v.addf(prefix+"MTU", "%d is out of range", o.MTU)
+	}
+	if o.FirewallMark < 0 || int64(o.FirewallMark) > math.MaxUint32 {
+		v.addf(prefix+"FirewallMark", "%d is out of range", o.FirewallMark)
+	}
+	if o.Table < 0 || int64(o.Table) > math.MaxUint32 {
+		v.addf(prefix+"Table", "%d is out of range", o.Table)
+	}
+}
+
+// validateEndpoint checks that endpoint is in the host:port form WireGuard accepts.
+func validateEndpoint(endpoint string) error {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("host must not be blank")
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
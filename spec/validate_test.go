@@ -0,0 +1,45 @@
+package spec
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/nyiyui/qrystal/goal"
+)
+
+func TestValidate(t *testing.T) {
+	s := Spec{Networks: []Network{
+		{
+			Name: "qrystal0",
+			Devices: []NetworkDevice{
+				{NetworkDeviceCensored: NetworkDeviceCensored{Name: "a", Endpoints: Endpoints("a.example.com:51820"), Addresses: []goal.IPNet{mustIPNet("10.10.0.1/32")}}, AccessControl: AccessControl{AccessAll: true}},
+				{NetworkDeviceCensored: NetworkDeviceCensored{Name: "b", Endpoints: Endpoints("192.168.0.1"), Addresses: []goal.IPNet{mustIPNet("10.10.0.2/32"), mustIPNet("10.10.0.1/32")}, Accessible: []string{"c"}}, AccessControl: AccessControl{AccessOnly: []string{"a", "c"}}},
+			},
+		},
+		{Name: "qrystal0", LinkOptions: LinkOptions{MTU: 10}},
+		{Name: "qrystal-too-long"},
+	}}
+	err := s.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+	paths := make([]string, len(errs))
+	for i, err := range errs {
+		paths[i] = err.Path
+	}
+	slices.Sort(paths)
+	expected := []string{
+		"Networks[0].Devices[0].Addresses[0]",
+		"Networks[0].Devices[1].AccessOnly[1]",
+		"Networks[0].Devices[1].Accessible[0]",
+		"Networks[0].Devices[1].Endpoints[0]",
+		"Networks[1].MTU",
+		"Networks[1].Name",
+		"Networks[2].Name",
+	}
+	if !slices.Equal(paths, expected) {
+		t.Fatalf("unexpected problems:\n%s", err)
+	}
+}